@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// stringVector is a flag.Value collecting every occurrence of a repeatable
+// flag
+type stringVector []string
+
+func (v *stringVector) String() string {
+	return strings.Join(*v, " ")
+}
+
+func (v *stringVector) Set(s string) error {
+	*v = append(*v, s)
+	return nil
+}
+
+// placeholderMapping returns the placeholders which can be used in asset
+// paths, mapped to their values for a build in gopath of the project whose
+// source is in projpath. User defined placeholders are given as NAME=value,
+// making <NAME> stand for value; they can't redefine the builtin ones.
+func placeholderMapping(gopath, projpath string, defines []string) (map[string]string, error) {
+	m := map[string]string{
+		"<GOPATH>":   gopath,
+		"<PROJPATH>": projpath,
+	}
+	for _, d := range defines {
+		parts := strings.SplitN(d, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(parts[0], "<>") {
+			return nil, fmt.Errorf("bad placeholder definition %q: must be of the form NAME=value", d)
+		}
+		name := "<" + parts[0] + ">"
+		if _, ok := m[name]; ok {
+			return nil, fmt.Errorf("placeholder %s is already defined", name)
+		}
+		m[name] = parts[1]
+	}
+	return m, nil
+}
+
+// replacePlaceholders replaces all placeholders in s with their values
+func replacePlaceholders(s string, placeholders map[string]string) string {
+	for p, v := range placeholders {
+		s = strings.Replace(s, p, v, -1)
+	}
+	return s
+}
+
+// zoneinfoDirs are the places the timezone database is looked for on the
+// build host, in order
+var zoneinfoDirs = []string{
+	"/usr/share/zoneinfo",
+	"/usr/lib/zoneinfo",
+	"/usr/share/lib/zoneinfo",
+}
+
+// addTzdata adds the timezone database of the build host to the rootfs, in
+// /usr/share/zoneinfo where programs expect it
+func addTzdata(fs *rootfs) error {
+	for _, d := range zoneinfoDirs {
+		if _, err := os.Stat(d); err == nil {
+			_, err := fs.addTree("usr/share/zoneinfo", d)
+			return err
+		}
+	}
+	return fmt.Errorf("could not find the timezone database in any of %s", strings.Join(zoneinfoDirs, ", "))
+}
+
+// addAsset adds the files described by spec, of the form
+// <path on host>:<path in image>, to the rootfs. The host path may be a glob,
+// in which a "**" element matches any number of directories; the path in the
+// image is then the directory the matches are placed in, keeping their paths
+// relative to the part of the host path before the first wildcard. The paths
+// in the image of the regular files added are returned.
+func addAsset(fs *rootfs, spec string) ([]string, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("bad asset %q: must be of the form <path on host>:<path in image>", spec)
+	}
+	src, dst := filepath.Clean(parts[0]), parts[1]
+
+	if !hasGlob(src) {
+		return fs.addTree(dst, src)
+	}
+	base := globBase(src)
+	matches, err := expandGlob(src)
+	if err != nil {
+		return nil, fmt.Errorf("bad asset %q: %v", spec, err)
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("asset %q matches no files", spec)
+	}
+	var files []string
+	var dirs []string
+	for _, m := range matches {
+		// A directory is added with its contents, which "**" matches
+		// as well
+		if under(m, dirs) {
+			continue
+		}
+		if info, err := os.Lstat(m); err == nil && info.IsDir() {
+			dirs = append(dirs, m)
+		}
+		// Matches are walked on their own, so excluding a directory
+		// has to leave out the matches below it, too
+		ok, err := fs.excludedBelow(base, m)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			debug("excluding from rootfs: ", m)
+			continue
+		}
+		relpath, err := filepath.Rel(base, m)
+		if err != nil {
+			return nil, err
+		}
+		f, err := fs.addTree(path.Join(dst, filepath.ToSlash(relpath)), m)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f...)
+	}
+	return files, nil
+}
+
+// under reports whether p is below one of dirs
+func under(p string, dirs []string) bool {
+	for _, d := range dirs {
+		if p != d && within(d, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// runAssetHooks transforms the given regular files of the rootfs by running
+// each hook, a shell command in which {} stands for the file, on copies of
+// them made in dir, and puts the copies in the image instead of the
+// originals, which are left untouched
+func runAssetHooks(fs *rootfs, dir string, files, hooks []string) error {
+	// Assets may overlap, and the copy must only be hooked once
+	hooked := map[string]bool{}
+	for _, p := range files {
+		if hooked[p] {
+			continue
+		}
+		hooked[p] = true
+		src := fs.entries[p]
+		info, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		cp := filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(cp), 0755); err != nil {
+			return err
+		}
+		// Make sure the hooks can modify the copy
+		if err := copyRegularFile(src, cp, info.Mode().Perm()|0200); err != nil {
+			return err
+		}
+		for _, h := range hooks {
+			cmd := exec.CommandContext(ctx, "/bin/sh", "-c", strings.Replace(h, "{}", shellQuote(cp), -1))
+			cmd.Stdout = commandStdout()
+			cmd.Stderr = commandStderr()
+			logCommand(cmd.Args)
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("hook %q failed on %s: %v", h, src, err)
+			}
+		}
+		if err := os.Chmod(cp, info.Mode().Perm()); err != nil {
+			return err
+		}
+		fs.add(p, cp)
+	}
+	return nil
+}
+
+// shellQuote quotes s for use as a single word in a shell command
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func hasGlob(p string) bool {
+	return strings.ContainsAny(p, `*?[\`)
+}
+
+// globBase returns the longest leading part of pattern which contains no
+// wildcards
+func globBase(pattern string) string {
+	base := pattern
+	for hasGlob(base) {
+		base = filepath.Dir(base)
+	}
+	return base
+}
+
+// expandGlob returns the paths matching pattern, in lexical order
+func expandGlob(pattern string) ([]string, error) {
+	// Check the syntax up front, as Walk would silently skip everything
+	// on a bad pattern
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	base := globBase(pattern)
+	elems := strings.Split(filepath.ToSlash(pattern), "/")
+	var matches []string
+	err := filepath.Walk(base, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == base {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		ok, err := matchElems(elems, strings.Split(filepath.ToSlash(p), "/"))
+		if err != nil {
+			return err
+		}
+		if ok {
+			matches = append(matches, p)
+		}
+		return nil
+	})
+	return matches, err
+}
+
+// matchGlob reports whether the path name matches pattern, in which a "**"
+// element matches any number of path elements
+func matchGlob(pattern, name string) (bool, error) {
+	pattern, name = filepath.ToSlash(filepath.Clean(pattern)), filepath.ToSlash(filepath.Clean(name))
+	return matchElems(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// matchElems reports whether the elements of a path match those of a pattern,
+// where a "**" pattern element matches any number of path elements and all
+// others are matched with filepath.Match
+func matchElems(pattern, name []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if ok, err := matchElems(pattern[1:], name[i:]); ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(name) == 0 {
+			return false, nil
+		}
+		if ok, err := filepath.Match(pattern[0], name[0]); !ok || err != nil {
+			return false, err
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0, nil
+}
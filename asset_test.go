@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"/a/*.go", "/a/x.go", true},
+		{"/a/*.go", "/a/b/x.go", false},
+		{"/a/**/*.go", "/a/x.go", true},
+		{"/a/**/*.go", "/a/b/c/x.go", true},
+		{"/a/**/*.go", "/a/b/c/x.txt", false},
+		{"/a/**", "/a", true},
+		{"/a/**", "/a/b/c", true},
+		{"/a/**", "/b/c", false},
+		{"/a/**/b", "/a/b", true},
+		{"/a/**/b", "/a/x/y/b", true},
+		{"/a/**/b", "/a/x/y/b/c", false},
+		{"/a/**/**/b", "/a/b", true},
+		{"/a/b?", "/a/bc", true},
+		{"/a/[bc]", "/a/d", false},
+		{"/a/b/", "/a/b", true},
+	}
+	for _, tt := range tests {
+		got, err := matchGlob(tt.pattern, tt.name)
+		if err != nil {
+			t.Errorf("matchGlob(%q, %q): %v", tt.pattern, tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+	if _, err := matchGlob("/a/[", "/a/["); err == nil {
+		t.Errorf("matchGlob accepted a bad pattern")
+	}
+}
+
+// writeTree creates the given files, with their parent directories, in dir
+func writeTree(t *testing.T, dir string, files ...string) {
+	for _, f := range files {
+		p := filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExpandGlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goaci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, "a.go", "b.txt", "sub/c.go", "sub/deeper/d.go")
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"*.go", []string{"a.go"}},
+		{"**/*.go", []string{"a.go", "sub/c.go", "sub/deeper/d.go"}},
+		{"sub/**", []string{"sub", "sub/c.go", "sub/deeper", "sub/deeper/d.go"}},
+		{"missing/**", nil},
+	}
+	for _, tt := range tests {
+		got, err := expandGlob(filepath.Join(dir, tt.pattern))
+		if err != nil {
+			t.Errorf("expandGlob(%q): %v", tt.pattern, err)
+			continue
+		}
+		var rel []string
+		for _, m := range got {
+			r, err := filepath.Rel(dir, m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rel = append(rel, filepath.ToSlash(r))
+		}
+		if !reflect.DeepEqual(rel, tt.want) {
+			t.Errorf("expandGlob(%q) = %q, want %q", tt.pattern, rel, tt.want)
+		}
+	}
+	if _, err := expandGlob(filepath.Join(dir, "[")); err == nil {
+		t.Errorf("expandGlob accepted a bad pattern")
+	}
+}
+
+func TestAddAssetGlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goaci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, "etc/a.conf", "etc/sub/b.conf", "etc/sub/deeper/c.conf", "etc/skip/d.conf")
+
+	tests := []struct {
+		asset    string
+		excludes []string
+		want     []string
+	}{
+		{"etc/**:/etc/app", nil, []string{
+			"etc/app/a.conf",
+			"etc/app/skip/d.conf",
+			"etc/app/sub/b.conf",
+			"etc/app/sub/deeper/c.conf",
+		}},
+		{"etc/**/*.conf:/conf", nil, []string{
+			"conf/a.conf",
+			"conf/skip/d.conf",
+			"conf/sub/b.conf",
+			"conf/sub/deeper/c.conf",
+		}},
+		{"etc/*.conf:/conf", nil, []string{
+			"conf/a.conf",
+		}},
+		// Excluding a directory leaves out what "**" matches below it
+		{"etc/**:/etc/app", []string{"etc/sub"}, []string{
+			"etc/app/a.conf",
+			"etc/app/skip/d.conf",
+		}},
+		{"etc/**/*.conf:/conf", []string{"etc/s*"}, []string{
+			"conf/a.conf",
+		}},
+		{"etc:/etc/app", []string{"etc/sub"}, []string{
+			"etc/app/a.conf",
+			"etc/app/skip/d.conf",
+		}},
+		{"etc:/etc/app", []string{"**/*.conf"}, nil},
+		{"etc/**/*.conf:/conf", []string{"etc/s*/*.conf"}, []string{
+			"conf/a.conf",
+			"conf/sub/deeper/c.conf",
+		}},
+	}
+	for _, tt := range tests {
+		fs := newRootfs()
+		for _, e := range tt.excludes {
+			fs.excludes = append(fs.excludes, filepath.Join(dir, e))
+		}
+		files, err := addAsset(fs, filepath.Join(dir, tt.asset))
+		if err != nil {
+			t.Errorf("addAsset(%q): %v", tt.asset, err)
+			continue
+		}
+		sort.Strings(files)
+		if !reflect.DeepEqual(files, tt.want) {
+			t.Errorf("addAsset(%q) with excludes %q added %q, want %q", tt.asset, tt.excludes, files, tt.want)
+		}
+	}
+	if _, err := addAsset(newRootfs(), filepath.Join(dir, "etc/*.txt:/etc")); err == nil {
+		t.Errorf("addAsset accepted a glob matching no files")
+	}
+}
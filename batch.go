@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	commands["batch"] = runBatch
+}
+
+// batchBuild is a project built by goaci batch, with flags of its own
+type batchBuild struct {
+	pkg   string
+	flags []string
+
+	out     bytes.Buffer
+	err     error
+	written []string
+	took    time.Duration
+}
+
+// runBatch builds images for several projects at once, each with goaci
+// anew, and reports how every build went once they are all done. The flags
+// given to goaci batch, like -cache-dir, apply to every build; so the cache
+// is shared by all of them.
+func runBatch(args []string) {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	file := fs.String("f", "", "file listing the projects to build, one per line, as the package followed by flags of its own; empty lines and lines starting with # are ignored")
+	parallel := fs.Int("parallel", runtime.NumCPU(), "how many projects to build at once")
+	fs.Parse(args)
+	if (*file == "" && fs.NArg() == 0) || *parallel < 1 {
+		die("usage: goaci [flags] batch [-parallel N] [-f FILE] [PACKAGE...]")
+	}
+	var builds []*batchBuild
+	for _, pkg := range fs.Args() {
+		builds = append(builds, &batchBuild{pkg: pkg})
+	}
+	if *file != "" {
+		listed, err := readBatchFile(*file)
+		if err != nil {
+			die("error reading %s: %v", *file, err)
+		}
+		builds = append(builds, listed...)
+	}
+	if output != "" && len(builds) > 1 {
+		if fi, err := os.Stat(output); err != nil || !fi.IsDir() {
+			die("-output must be an existing directory when building several projects")
+		}
+	}
+	self, err := os.Executable()
+	if err != nil {
+		die(err.Error())
+	}
+	// What the builds report is logged here, and each writes its
+	// profiles to files of its own, with its number appended
+	shared := withoutFlags(commandFlags(args), "log-file", "cpuprofile", "memprofile")
+
+	// Running builds get interrupts from the terminal, too
+	handleInterrupts()
+	slots := make(chan struct{}, *parallel)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i, b := range builds {
+		if *cpuProfile != "" {
+			b.flags = append([]string{fmt.Sprintf("-cpuprofile=%s.%d", *cpuProfile, i+1)}, b.flags...)
+		}
+		if *memProfile != "" {
+			b.flags = append([]string{fmt.Sprintf("-memprofile=%s.%d", *memProfile, i+1)}, b.flags...)
+		}
+		wg.Add(1)
+		go func(b *batchBuild) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			if ctx.Err() != nil {
+				b.err = ctx.Err()
+				return
+			}
+			b.run(self, shared)
+			// The output of a build is only printed once it is done, so
+			// that builds running at once don't mix theirs up
+			mu.Lock()
+			defer mu.Unlock()
+			logLine(stderr, "==> "+b.pkg)
+			stderr.Write(b.out.Bytes())
+		}(b)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, b := range builds {
+		took := b.took.Round(100 * time.Millisecond)
+		if b.err != nil {
+			failed++
+			info("FAIL %s (%v): %v", b.pkg, took, b.err)
+			continue
+		}
+		info("ok   %s (%v): %s", b.pkg, took, strings.Join(b.written, ", "))
+	}
+	if failed > 0 {
+		die("%d of %d builds failed", failed, len(builds))
+	}
+}
+
+// readBatchFile reads the projects listed in the file at path
+func readBatchFile(path string) ([]*batchBuild, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var builds []*batchBuild
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if strings.HasPrefix(fields[0], "-") {
+			return nil, fmt.Errorf("line %d: the package must come first", n)
+		}
+		builds = append(builds, &batchBuild{pkg: fields[0], flags: fields[1:]})
+	}
+	return builds, s.Err()
+}
+
+// run builds b by running goaci with the shared flags, then those of b
+func (b *batchBuild) run(self string, shared []string) {
+	start := time.Now()
+	defer func() { b.took = time.Since(start) }()
+	args := append(append([]string(nil), shared...), b.flags...)
+	args = append(args, b.pkg)
+	// Not stopped through ctx: an interrupt from the terminal reaches the
+	// build, too, which then cleans up after itself
+	cmd := exec.Command(self, args...)
+	cmd.Stdout = &b.out
+	cmd.Stderr = &b.out
+	logCommand(cmd.Args)
+	b.err = cmd.Run()
+	s := bufio.NewScanner(bytes.NewReader(b.out.Bytes()))
+	for s.Scan() {
+		if f := wroteFile(s.Text()); f != "" {
+			b.written = append(b.written, f)
+		}
+	}
+}
+
+// wroteFile returns the file a line of the output of goaci reports as
+// written, if any, whether goaci reports as text or as JSON
+func wroteFile(line string) string {
+	var e logEvent
+	if json.Unmarshal([]byte(line), &e) == nil {
+		line = e.Msg
+	}
+	if !strings.HasPrefix(line, "Wrote ") {
+		return ""
+	}
+	return strings.TrimPrefix(line, "Wrote ")
+}
+
+// withoutFlags returns the command line args without the flags named, which
+// must take a value, given as -name value or -name=value
+func withoutFlags(args []string, names ...string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		parts := strings.SplitN(strings.TrimLeft(args[i], "-"), "=", 2)
+		drop := false
+		for _, n := range names {
+			drop = drop || (strings.HasPrefix(args[i], "-") && parts[0] == n)
+		}
+		switch {
+		case !drop:
+			out = append(out, args[i])
+		case len(parts) == 1:
+			// The value is the next argument
+			i++
+		}
+	}
+	return out
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+func init() {
+	commands["builders"] = runBuilders
+}
+
+// builder describes a kind of project goaci can build
+type builder struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Placeholders maps the placeholders which can be used in asset
+	// paths to what they stand for
+	Placeholders map[string]string `json:"placeholders"`
+	// Flags maps the names of the flags only relevant to this builder to
+	// their usage; it is filled in from flags
+	Flags map[string]string `json:"flags"`
+	flags []string
+}
+
+// builders are the kinds of projects goaci can build
+var builders = []builder{
+	{
+		Name:        "go",
+		Description: "fetches a go package with go get, or takes it from a local directory, and builds it statically",
+		Placeholders: map[string]string{
+			"<GOPATH>":   "the GOPATH the project is built in",
+			"<PROJPATH>": "the source directory of the project",
+		},
+		flags: []string{
+			"all-binaries", "allow-dynamic", "build-env", "build-in-container", "cache-dir", "cgo",
+			"expect-commit", "forbid-dirty", "go-generate", "go-ldflags", "go-private", "go-proxy",
+			"go-tags", "local-source", "patch", "reproducible", "revision", "run-tests",
+			"source-sha256", "stamp-version", "use-vendor",
+		},
+	},
+}
+
+// runBuilders lists the builders, with their placeholders and flags, as text
+// or as JSON with -json
+func runBuilders(args []string) {
+	fs := flag.NewFlagSet("builders", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "list the builders as JSON")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		die("usage: goaci builders [-json]")
+	}
+
+	var list []builder
+	for _, b := range builders {
+		b.Flags = map[string]string{}
+		for _, name := range b.flags {
+			b.Flags[name] = flag.Lookup(name).Usage
+		}
+		list = append(list, b)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(list); err != nil {
+			die(err.Error())
+		}
+		return
+	}
+	for _, b := range list {
+		fmt.Printf("%s: %s\n", b.Name, b.Description)
+		fmt.Println("  placeholders:")
+		for _, p := range sortedKeys(b.Placeholders) {
+			fmt.Printf("    %s\t%s\n", p, b.Placeholders[p])
+		}
+		fmt.Println("  flags:")
+		for _, f := range sortedKeys(b.Flags) {
+			fmt.Printf("    -%s\t%s\n", f, b.Flags[f])
+		}
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
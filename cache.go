@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// buildKey returns the key under which the binaries built from the checkout
+// in projpath are kept in the cache directory. It covers everything going
+// into the build: the revision of the checkout and the files below projpath
+// (or the root of its module) which are not under version control, apart
+// from the outputs, the versions of goaci and go, the go command line
+// args building target, the flags changing what is built, the ldflags
+// (including the version stamped into the binaries) and the environment.
+// The key is empty if the binaries can't be cached, as the source isn't in
+// version control or has uncommitted changes.
+func buildKey(gocmd, projpath, target string, args, env []string, ldflags string, outputs []string) (string, error) {
+	if _, err := os.Stat(projpath); err != nil {
+		return "", nil
+	}
+	vcs, err := readVCSInfo(projpath)
+	if err != nil || vcs == nil || vcs.dirty {
+		return "", err
+	}
+	gover, err := goCommand(nil, "", []string{gocmd, "version"}).Output()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintln(h, "goaci", Version, runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintln(h, strings.TrimSpace(string(gover)), *buildImage)
+	fmt.Fprintln(h, vcs.vcs, vcs.rev)
+	// Untracked and ignored files, like generated code, are built as well.
+	// Other packages of a module may be, too.
+	root, _, ok, err := findModule(projpath)
+	if err != nil {
+		return "", err
+	}
+	dir := projpath
+	if ok {
+		dir = root
+	}
+	if err := hashUntracked(h, dir, outputs); err != nil {
+		return "", err
+	}
+	fmt.Fprintln(h, strings.Join(args, " "), target)
+	fmt.Fprintln(h, ldflags, *reproducible, *goGenerate, *runTests)
+	for _, e := range env {
+		// GOBIN is in the temporary directory
+		if !strings.HasPrefix(e, "GOBIN=") {
+			fmt.Fprintln(h, e)
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// hashUntracked writes the names and hashes of the files not under version
+// control below dir to w, apart from the outputs, which change with every
+// build (see outputPaths)
+func hashUntracked(w io.Writer, dir string, outputs []string) error {
+	files, err := untrackedFiles(dir)
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		abs := filepath.Join(dir, filepath.FromSlash(f))
+		skip, err := matchAny(outputs, abs)
+		if err != nil {
+			return err
+		}
+		if skip {
+			continue
+		}
+		sum, err := fileSHA256(abs)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s %x\n", f, sum)
+	}
+	return nil
+}
+
+// outputPaths returns the absolute paths of what goaci writes when building
+// images named after base, with the extension ext, as patterns for matchGlob
+// which also match what is below them: the image files, their signatures
+// and checksums, the dependency images, the output, cache and log files.
+func outputPaths(base, ext string) ([]string, error) {
+	bases := []string{base}
+	if *allBinaries {
+		bases = append(bases, base+"-*")
+	}
+	var paths []string
+	for _, b := range bases {
+		ofn := outputFile(b, ext)
+		for _, f := range []string{ofn, depsOutputFile(ofn, "goaci-deps-*")} {
+			paths = append(paths, f, f+".asc", f+".sha512")
+		}
+	}
+	paths = append(paths, *outputDir, *cacheDir, *logFilePath, *cpuProfile, *memProfile)
+	var patterns []string
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, abs, filepath.Join(abs, "**"))
+	}
+	return patterns, nil
+}
+
+// matchAny reports whether p matches any of the patterns, as by matchGlob
+func matchAny(patterns []string, p string) (bool, error) {
+	for _, pattern := range patterns {
+		if ok, err := matchGlob(pattern, p); ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// cachedBinaries returns the directory the binaries with the given key are
+// kept in
+func cachedBinaries(key string) string {
+	return filepath.Join(*cacheDir, "binaries", key)
+}
+
+// restoreBinaries copies the binaries cached under key to gobin, and reports
+// whether there were any
+func restoreBinaries(key, gobin string) (bool, error) {
+	dir := cachedBinaries(key)
+	fi, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(gobin, 0755); err != nil {
+		return false, err
+	}
+	for _, f := range fi {
+		if err := copyRegularFile(filepath.Join(dir, f.Name()), filepath.Join(gobin, f.Name()), f.Mode().Perm()); err != nil {
+			return false, err
+		}
+	}
+	return len(fi) > 0, nil
+}
+
+// storeBinaries copies the binaries in gobin to the cache under key. They
+// are copied to a temporary directory first, so that concurrent builds never
+// see only some of them.
+func storeBinaries(key, gobin string) error {
+	dir := cachedBinaries(key)
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), "tmp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	fi, err := ioutil.ReadDir(gobin)
+	if err != nil {
+		return err
+	}
+	for _, f := range fi {
+		if err := copyRegularFile(filepath.Join(gobin, f.Name()), filepath.Join(tmp, f.Name()), f.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	// TempDir creates it only accessible by us
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil && !os.IsExist(err) {
+		// Another build got there first
+		if _, serr := os.Stat(dir); serr != nil {
+			return err
+		}
+	}
+	return nil
+}
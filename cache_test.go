@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildKey(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not installed")
+	}
+	dir := gitRepo(t)
+	defer os.RemoveAll(dir)
+	env := []string{"GOPATH=/tmp/gopath", "GOBIN=/tmp/gopath/bin"}
+	outputs := []string{filepath.Join(dir, "app.aci"), filepath.Join(dir, "images", "**")}
+	key := func(args, env []string) string {
+		k, err := buildKey("go", dir, "example.com/app", args, env, "-w", outputs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	k := key(nil, env)
+	if k == "" {
+		t.Fatal("no key for a clean checkout")
+	}
+	if k2 := key(nil, env); k2 != k {
+		t.Errorf("keys of the same build differ: %s and %s", k, k2)
+	}
+	// GOBIN is a temporary directory which changes with every build
+	if k2 := key(nil, []string{"GOPATH=/tmp/gopath", "GOBIN=/tmp/other/bin"}); k2 != k {
+		t.Errorf("the key depends on GOBIN")
+	}
+	if key([]string{"-race"}, env) == k {
+		t.Errorf("the key doesn't depend on the go args")
+	}
+	if key(nil, append(env, "CGO_ENABLED=1")) == k {
+		t.Errorf("the key doesn't depend on the environment")
+	}
+	// The linker flags carry the version stamped into the binaries
+	if k2, err := buildKey("go", dir, "example.com/app", nil, env, "-w -X main.version=v2", outputs); err != nil || k2 == k {
+		t.Errorf("the key doesn't depend on the linker flags (%v)", err)
+	}
+
+	// Untracked files, like generated code, are built, too, but not the
+	// images goaci writes
+	if err := ioutil.WriteFile(filepath.Join(dir, "gen.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	withGen := key(nil, env)
+	if withGen == "" || withGen == k {
+		t.Errorf("key %s with an untracked file, want a new one", withGen)
+	}
+	writeTree(t, dir, "app.aci", "images/app.aci")
+	if k2 := key(nil, env); k2 != withGen {
+		t.Errorf("the key depends on the images written")
+	}
+	// Only what goaci writes is left out, whatever its name
+	writeTree(t, dir, "testdata/other.aci")
+	if k2 := key(nil, env); k2 == withGen {
+		t.Errorf("the key doesn't depend on an untracked file named like an image")
+	}
+	if err := os.RemoveAll(filepath.Join(dir, "testdata")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "gen.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("package other\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if k := key(nil, env); k != "" {
+		t.Errorf("key %s for a checkout with uncommitted changes", k)
+	}
+	run(t, dir, "git", "-c", "user.name=goaci", "-c", "user.email=goaci@example.com", "commit", "--quiet", "-am", "change")
+	if k2 := key(nil, env); k2 == "" || k2 == k {
+		t.Errorf("key %s after a new commit, want a new one", k2)
+	}
+	if k, err := buildKey("go", filepath.Join(dir, "missing"), "example.com/app", nil, env, "-w", outputs); k != "" || err != nil {
+		t.Errorf("buildKey of a missing directory = %q, %v", k, err)
+	}
+}
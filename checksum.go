@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// imageKeyLen is the length of the keys rkt uses for images in its store:
+// the hash prefix followed by half of the hex-encoded sha512
+const imageKeyLen = len("sha512-") + sha512.Size
+
+// imageKey returns the key under which rkt stores an ACI, given the sha512 of
+// the uncompressed image tarball
+func imageKey(h hash.Hash) string {
+	return ("sha512-" + hex.EncodeToString(h.Sum(nil)))[:imageKeyLen]
+}
+
+// writeChecksum writes the sha512 of the file at path to path.sha512, in the
+// format understood by `sha512sum -c`, and returns the checksum file's path
+func writeChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha512.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := path + ".sha512"
+	line := fmt.Sprintf("%x  %s\n", h.Sum(nil), filepath.Base(path))
+	return sum, ioutil.WriteFile(sum, []byte(line), 0644)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+
+	"github.com/appc/spec/schema/types"
+)
+
+// ciSystem describes how a CI system tells the jobs it runs about the build
+type ciSystem struct {
+	name string
+	// detect is a variable only set by this CI system
+	detect string
+	// number, url and commit are the variables holding the number of the
+	// build, the URL of its page and the commit it builds
+	number, url, commit string
+	// buildURL, if set, puts together the URL of the page of the build,
+	// for systems without a variable holding it
+	buildURL func() string
+}
+
+var ciSystems = []ciSystem{
+	{
+		name:   "github-actions",
+		detect: "GITHUB_ACTIONS",
+		number: "GITHUB_RUN_NUMBER",
+		commit: "GITHUB_SHA",
+		buildURL: func() string {
+			if os.Getenv("GITHUB_RUN_ID") == "" {
+				return ""
+			}
+			return os.Getenv("GITHUB_SERVER_URL") + "/" + os.Getenv("GITHUB_REPOSITORY") + "/actions/runs/" + os.Getenv("GITHUB_RUN_ID")
+		},
+	},
+	{name: "gitlab-ci", detect: "GITLAB_CI", number: "CI_PIPELINE_IID", url: "CI_JOB_URL", commit: "CI_COMMIT_SHA"},
+	{name: "travis-ci", detect: "TRAVIS", number: "TRAVIS_BUILD_NUMBER", url: "TRAVIS_BUILD_WEB_URL", commit: "TRAVIS_COMMIT"},
+	{name: "circleci", detect: "CIRCLECI", number: "CIRCLE_BUILD_NUM", url: "CIRCLE_BUILD_URL", commit: "CIRCLE_SHA1"},
+	{name: "buildkite", detect: "BUILDKITE", number: "BUILDKITE_BUILD_NUMBER", url: "BUILDKITE_BUILD_URL", commit: "BUILDKITE_COMMIT"},
+	// Jenkins sets no variable of its own in every job; JENKINS_URL is
+	// set unless the instance isn't configured with its URL
+	{name: "jenkins", detect: "JENKINS_URL", number: "BUILD_NUMBER", url: "BUILD_URL", commit: "GIT_COMMIT"},
+}
+
+// ciAnnotations returns the annotations recording the CI job goaci runs in,
+// as ci-system, ci-build-number, ci-build-url and ci-commit, or nothing if it
+// doesn't run in one of the CI systems it knows
+func ciAnnotations() types.Annotations {
+	for _, ci := range ciSystems {
+		if os.Getenv(ci.detect) == "" {
+			continue
+		}
+		url := os.Getenv(ci.url)
+		if ci.buildURL != nil {
+			url = ci.buildURL()
+		}
+		var as types.Annotations
+		for _, a := range []struct{ name, value string }{
+			{"ci-system", ci.name},
+			{"ci-build-number", os.Getenv(ci.number)},
+			{"ci-build-url", url},
+			{"ci-commit", os.Getenv(ci.commit)},
+		} {
+			if a.value != "" {
+				as = append(as, types.Annotation{Name: types.ACName(a.name), Value: a.value})
+			}
+		}
+		return as
+	}
+	return nil
+}
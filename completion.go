@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+func init() {
+	// Registered here, as the completions list the commands themselves
+	commands["completion"] = runCompletion
+}
+
+// runCompletion prints a script completing the commands and flags of goaci
+// for the given shell
+func runCompletion(args []string) {
+	if len(args) != 1 {
+		die("usage: goaci completion bash|zsh|fish")
+	}
+	var cmds []string
+	for c := range commands {
+		cmds = append(cmds, c)
+	}
+	sort.Strings(cmds)
+	var flags []string
+	flag.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, "-"+f.Name)
+	})
+
+	switch args[0] {
+	case "bash":
+		fmt.Printf(`_goaci() {
+	local cur=${COMP_WORDS[COMP_CWORD]}
+	case "$cur" in
+	-*) COMPREPLY=($(compgen -W "%s" -- "$cur")) ;;
+	*) COMPREPLY=($(compgen -W "%s" -- "$cur")) ;;
+	esac
+}
+complete -o default -F _goaci goaci
+`, strings.Join(flags, " "), strings.Join(cmds, " "))
+	case "zsh":
+		fmt.Printf(`#compdef goaci
+_goaci() {
+	if [[ $PREFIX == -* ]]; then
+		compadd -- %s
+	else
+		compadd -- %s
+		_files
+	fi
+}
+compdef _goaci goaci
+`, strings.Join(flags, " "), strings.Join(cmds, " "))
+	case "fish":
+		fmt.Printf("complete -c goaci -n __fish_use_subcommand -a '%s'\n", strings.Join(cmds, " "))
+		flag.VisitAll(func(f *flag.Flag) {
+			fmt.Printf("complete -c goaci -o %s -d '%s'\n", f.Name, fishQuote(summary(f.Usage)))
+		})
+	default:
+		die("unknown shell %q, must be bash, zsh or fish", args[0])
+	}
+}
+
+// summary returns the first part of a flag's usage, up to the end of the
+// first clause or sentence, to describe it in completions
+func summary(usage string) string {
+	for i := 0; i+2 < len(usage); i++ {
+		if usage[i+1] != ' ' {
+			continue
+		}
+		// Full stops of abbreviations like "e.g." aren't followed by
+		// a capital letter
+		if usage[i] == ';' || usage[i] == '.' && unicode.IsUpper(rune(usage[i+2])) {
+			return usage[:i]
+		}
+	}
+	return strings.TrimSuffix(usage, ".")
+}
+
+// fishQuote escapes s for use within single quotes in fish
+func fishQuote(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+
+	"github.com/klauspost/pgzip"
+)
+
+// compressJobs is how many blocks are compressed in parallel, or 0 for the
+// default of the algorithm
+var compressJobs int
+
+// newCompressor returns a WriteCloser which compresses everything written to
+// it with the given algorithm before passing it on to w. Closing it flushes
+// any buffered data but does not close w. A level of 0 selects the default
+// compression level of the algorithm, otherwise it must be between 1 (fastest)
+// and 9 (best compression).
+func newCompressor(w io.Writer, algo string, level int) (io.WriteCloser, error) {
+	if err := checkCompression(algo, level); err != nil {
+		return nil, err
+	}
+	switch algo {
+	case "gzip":
+		if level == 0 {
+			level = pgzip.DefaultCompression
+		}
+		// Compress blocks in parallel, as compression is by far the
+		// slowest part of writing large images. The header is left
+		// empty, so it holds no timestamp which would make otherwise
+		// identical images differ.
+		zw, err := pgzip.NewWriterLevel(w, level)
+		if err != nil || compressJobs == 0 {
+			return zw, err
+		}
+		// The default block size of pgzip
+		return zw, zw.SetConcurrency(1<<20, compressJobs)
+	case "xz":
+		return newXzWriter(w, level)
+	case "none":
+		return nopCloser{w}, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q (must be one of gzip, xz, none)", algo)
+}
+
+// checkCompression checks that newCompressor accepts algo and level
+func checkCompression(algo string, level int) error {
+	if level < 0 || level > 9 {
+		return fmt.Errorf("compression level must be between 1 and 9")
+	}
+	switch algo {
+	case "gzip", "xz", "none":
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q (must be one of gzip, xz, none)", algo)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// xzWriter compresses by piping through the xz binary, as there is no xz
+// encoder in the standard library
+type xzWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func newXzWriter(w io.Writer, level int) (*xzWriter, error) {
+	xzcmd, err := exec.LookPath("xz")
+	if err != nil {
+		return nil, fmt.Errorf("could not find `xz` in path")
+	}
+	args := []string{xzcmd, "--compress", "--stdout"}
+	if level != 0 {
+		args = append(args, fmt.Sprintf("-%d", level))
+	}
+	if compressJobs != 0 {
+		args = append(args, fmt.Sprintf("--threads=%d", compressJobs))
+	}
+	cmd := exec.CommandContext(ctx, xzcmd, args[1:]...)
+	cmd.Stdout = w
+	cmd.Stderr = commandStderr()
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	logCommand(args)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &xzWriter{in, cmd}, nil
+}
+
+func (x *xzWriter) Close() error {
+	if err := x.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return x.cmd.Wait()
+}
+
+// newDecompressor returns a ReadCloser which decompresses what is read from
+// r, detecting the compression (gzip, xz or none) from its magic number.
+// Closing it does not close r.
+func newDecompressor(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return newXzReader(br)
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+// xzReader decompresses by piping through the xz binary
+type xzReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func newXzReader(r io.Reader) (*xzReader, error) {
+	xzcmd, err := exec.LookPath("xz")
+	if err != nil {
+		return nil, fmt.Errorf("could not find `xz` in path")
+	}
+	cmd := exec.CommandContext(ctx, xzcmd, "--decompress", "--stdout")
+	cmd.Stdin = r
+	cmd.Stderr = commandStderr()
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	logCommand(cmd.Args)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &xzReader{out, cmd}, nil
+}
+
+// Close stops xz, whether or not everything was read
+func (x *xzReader) Close() error {
+	x.ReadCloser.Close()
+	x.cmd.Process.Kill()
+	x.cmd.Wait()
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os/exec"
+	"testing"
+)
+
+// decompress undoes the compression of b, whichever newDecompressor detects
+func decompress(t *testing.T, b []byte) []byte {
+	r, err := newDecompressor(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestCompressor(t *testing.T) {
+	data := bytes.Repeat([]byte("goaci compresses images\n"), 10000)
+	for _, algo := range []string{"gzip", "xz", "none"} {
+		if _, err := exec.LookPath("xz"); algo == "xz" && err != nil {
+			t.Log("xz is not installed")
+			continue
+		}
+		for _, level := range []int{0, 1, 9} {
+			var buf bytes.Buffer
+			w, err := newCompressor(&buf, algo, level)
+			if err != nil {
+				t.Fatalf("newCompressor(%q, %d): %v", algo, level, err)
+			}
+			if _, err := w.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if algo != "none" && buf.Len() >= len(data) {
+				t.Errorf("%s level %d: %d bytes compressed to %d", algo, level, len(data), buf.Len())
+			}
+			if got := decompress(t, buf.Bytes()); !bytes.Equal(got, data) {
+				t.Errorf("%s level %d: got %d bytes back, want the %d written", algo, level, len(got), len(data))
+			}
+		}
+	}
+	for _, tt := range []struct {
+		algo  string
+		level int
+	}{
+		{"bzip2", 0},
+		{"gzip", -1},
+		{"gzip", 10},
+	} {
+		if _, err := newCompressor(ioutil.Discard, tt.algo, tt.level); err == nil {
+			t.Errorf("newCompressor(%q, %d) succeeded", tt.algo, tt.level)
+		}
+	}
+}
+
+func TestCompressorParallelGzip(t *testing.T) {
+	// Enough data for pgzip to compress several blocks at once
+	data := make([]byte, 5<<20)
+	rand.New(rand.NewSource(1)).Read(data[:len(data)/2])
+	var images [2]bytes.Buffer
+	for i := range images {
+		w, err := newCompressor(&images[i], "gzip", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(images[0].Bytes(), images[1].Bytes()) {
+		t.Errorf("compressing the same data twice gives different results")
+	}
+	if got := decompress(t, images[0].Bytes()); !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes back, want the %d written", len(got), len(data))
+	}
+}
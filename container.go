@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// containerMounts are the directories of the host mounted, at the same
+// paths, in the container go is run in with -build-in-container
+var containerMounts []string
+
+// goCommand returns the command running go, as given by args, in the
+// directory dir with the environment env: on the host, or with
+// -build-in-container in a container of that image, with the go of the
+// image. The container only gets the go variables of env, not the
+// variables passed on from goaci's environment, and runs as the same user
+// as goaci, so that what it writes can be cleaned up.
+func goCommand(env []string, dir string, args []string) *exec.Cmd {
+	if *buildImage == "" {
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Env = env
+		cmd.Dir = dir
+		return cmd
+	}
+	run := []string{"run", "--rm", "--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())}
+	for _, m := range containerMounts {
+		run = append(run, "--volume", m+":"+m)
+	}
+	if dir != "" {
+		run = append(run, "--workdir", dir)
+	}
+	// The go of the image has its own GOROOT and PATH
+	run = append(run, "--env", "HOME=/tmp")
+	for _, e := range env {
+		if !hostVariable(e) {
+			run = append(run, "--env", e)
+		}
+	}
+	run = append(run, *buildImage, "go")
+	return exec.CommandContext(ctx, "docker", append(run, args[1:]...)...)
+}
+
+// hostVariable reports whether the variable e, of the form NAME=value, only
+// applies to the host and is left out of the container
+func hostVariable(e string) bool {
+	name := strings.SplitN(e, "=", 2)[0]
+	if name == "GOROOT" || name == "PATH" {
+		return true
+	}
+	for _, v := range passedEnv {
+		if name == v {
+			return true
+		}
+	}
+	return false
+}
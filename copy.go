@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// copyRegularFile copies the contents of the regular file src to a new file
+// dst with the given permissions. Where the filesystem supports it, the copy
+// is a reflink sharing the data of src; otherwise the data is copied, in the
+// kernel with copy_file_range where available.
+func copyRegularFile(src, dst string, perm os.FileMode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if err := cloneFile(out, in); err != nil {
+		// io.Copy between files uses copy_file_range on Linux
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// Undo the umask
+	return os.Chmod(dst, perm)
+}
+
+// copyOwnerAndMode gives the file at path the owner, if running as root, and
+// the full mode, including the setuid, setgid and sticky bits, of the file
+// described by info
+func copyOwnerAndMode(path string, info os.FileInfo) error {
+	if uid, gid, ok := fileOwner(info); ok && os.Geteuid() == 0 {
+		if err := os.Lchown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	// Changing the owner clears the setuid and setgid bits, so this comes
+	// second
+	return os.Chmod(path, info.Mode()&permBits)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"runtime"
+	"strings"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func init() {
+	commands["discovery-meta"] = runDiscoveryMeta
+}
+
+// runDiscoveryMeta prints the appc discovery meta tags for serving an image,
+// and where the files goaci writes for it with -discovery-naming go
+func runDiscoveryMeta(args []string) {
+	fs := flag.NewFlagSet("discovery-meta", flag.ExitOnError)
+	url := fs.String("url", "", "URL the images are served below; defaults to https://{host of the image name}/images")
+	pubkeys := fs.String("pubkeys", "", "URL of the public keys the images are signed with, if they are")
+	version := fs.String("version", "latest", "version label of the image")
+	goos := fs.String("os", runtime.GOOS, "os label of the image")
+	goarch := fs.String("arch", runtime.GOARCH, "arch label of the image")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		die("usage: goaci discovery-meta [-url URL] [-pubkeys URL] [-version VERSION] [-os OS] [-arch ARCH] NAME")
+	}
+	name, err := types.NewACName(fs.Arg(0))
+	if err != nil {
+		die("bad image name: %v", err)
+	}
+	base := *url
+	if base == "" {
+		base = "https://" + strings.SplitN(name.String(), "/", 2)[0] + "/images"
+	}
+	base = strings.TrimSuffix(base, "/")
+
+	fmt.Printf("Serve these tags at https://%s?ac-discovery=1:\n\n", name)
+	fmt.Printf("\t<meta name=\"ac-discovery\" content=\"%s %s/{name}-{version}-{os}-{arch}.{ext}\">\n", name, base)
+	if *pubkeys != "" {
+		fmt.Printf("\t<meta name=\"ac-discovery-pubkeys\" content=\"%s %s\">\n", name, *pubkeys)
+	}
+	// {name} is the whole name, while the files goaci writes are named
+	// after its last component, so they go in a directory for the rest
+	file := fmt.Sprintf("%s-%s-%s-%s.aci", path.Base(name.String()), *version, *goos, *goarch)
+	dir := base
+	if d := path.Dir(name.String()); d != "." {
+		dir += "/" + d
+	}
+	fmt.Printf("\nand put the image built with goaci -discovery-naming -image-version %s at\n\n", *version)
+	fmt.Printf("\t%s/%s\n", dir, file)
+	if *pubkeys != "" {
+		fmt.Printf("\t%s/%s.asc (written with -sign-key)\n", dir, file)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/appc/spec/schema"
+)
+
+// dockerManifest is an entry of the manifest.json understood by `docker load`
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// writeDockerArchive builds a `docker load` compatible image in the scratch
+// directory dir, with the root filesystem fs as its only layer and a
+// configuration translated from im, and writes it as a tarball to w
+func writeDockerArchive(w io.Writer, dir string, fs *rootfs, im schema.ImageManifest, topts tarOptions) error {
+	blobdir := filepath.Join(dir, "blobs")
+	imgdir := filepath.Join(dir, "image")
+	for _, d := range []string{blobdir, imgdir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+
+	// Docker expects uncompressed layers, so the digest of the blob is the
+	// diff ID of the layer
+	_, diffID, err := writeLayerBlob(blobdir, fs, "none", 0, topts)
+	if err != nil {
+		return err
+	}
+	layerID := strings.TrimPrefix(diffID, "sha256:")
+	layerPath := filepath.Join(layerID, "layer.tar")
+	if err := os.Mkdir(filepath.Join(imgdir, layerID), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(blobdir, layerID), filepath.Join(imgdir, layerPath)); err != nil {
+		return err
+	}
+
+	img := ociImageFromManifest(im)
+	img.RootFS.DiffIDs = []string{diffID}
+	config, err := writeJSONBlob(imgdir, ociConfigMediaType, img)
+	if err != nil {
+		return err
+	}
+	configPath := strings.TrimPrefix(config.Digest, "sha256:") + ".json"
+	if err := os.Rename(filepath.Join(imgdir, strings.TrimSuffix(configPath, ".json")), filepath.Join(imgdir, configPath)); err != nil {
+		return err
+	}
+
+	manifest := []dockerManifest{{
+		Config:   configPath,
+		RepoTags: []string{im.Name.String() + ":" + labelValue(im, "version")},
+		Layers:   []string{filepath.ToSlash(layerPath)},
+	}}
+	if err := writeJSON(filepath.Join(imgdir, "manifest.json"), manifest); err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	if err := tarDir(tw, imgdir, topts); err != nil {
+		return err
+	}
+	return tw.Close()
+}
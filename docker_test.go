@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWriteDockerArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goaci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rfs := filepath.Join(dir, "rootfs")
+	if err := os.Mkdir(rfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rfs, "app"), []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fs := newRootfs()
+	if _, err := fs.addTree("", rfs); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := writeDockerArchive(&buf, filepath.Join(dir, "scratch"), fs, testManifest(t), tarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, files := tarNames(t, buf.Bytes())
+	var manifest []dockerManifest
+	if err := json.Unmarshal([]byte(files["manifest.json"]), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 1 || len(manifest[0].Layers) != 1 {
+		t.Fatalf("manifest.json = %+v, want one image with one layer", manifest)
+	}
+	if want := []string{"example.com/app:v1.0"}; !reflect.DeepEqual(manifest[0].RepoTags, want) {
+		t.Errorf("tags = %q, want %q", manifest[0].RepoTags, want)
+	}
+	var img ociImage
+	if err := json.Unmarshal([]byte(files[manifest[0].Config]), &img); err != nil {
+		t.Fatal(err)
+	}
+	layer, ok := files[manifest[0].Layers[0]]
+	if !ok {
+		t.Fatalf("layer %s missing from the archive", manifest[0].Layers[0])
+	}
+	if diffID := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(layer))); !reflect.DeepEqual(img.RootFS.DiffIDs, []string{diffID}) {
+		t.Errorf("diff IDs = %q, want the digest of the layer, %s", img.RootFS.DiffIDs, diffID)
+	}
+	if _, layerFiles := tarNames(t, []byte(layer)); layerFiles["app"] != "binary" {
+		t.Errorf("app in the layer holds %q", layerFiles["app"])
+	}
+}
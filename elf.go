@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// defaultLibDirs are searched for shared libraries after the directories
+// configured in ld.so.conf, as done by the dynamic loader
+var defaultLibDirs = []string{"/lib64", "/usr/lib64", "/lib", "/usr/lib"}
+
+// libResolver finds the shared libraries needed by ELF files by reading their
+// dynamic sections, the way the dynamic loader would. Unlike ldd, it never
+// executes the files it inspects, so it is safe to use on untrusted binaries
+// and on binaries built for another machine.
+type libResolver struct {
+	// libPath is searched like the dynamic loader searches
+	// LD_LIBRARY_PATH
+	libPath []string
+	// cache maps library names to their paths, as listed in ld.so.cache
+	cache map[string][]string
+	dirs  []string
+	// missing lists the libraries which could not be found, along with
+	// the file in the image needing them
+	missing []string
+}
+
+func newLibResolver(libPath []string) (*libResolver, error) {
+	dirs, err := readLdSoConf("/etc/ld.so.conf")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	cache, err := readLdSoCache("/etc/ld.so.cache")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &libResolver{
+		libPath: libPath,
+		cache:   cache,
+		dirs:    append(dirs, defaultLibDirs...),
+	}, nil
+}
+
+// readLdSoConf returns the library directories listed in an ld.so.conf file,
+// following its include directives
+func readLdSoConf(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var dirs []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case fields[0] == "include":
+			for _, pattern := range fields[1:] {
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(path), pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return nil, err
+				}
+				for _, m := range matches {
+					d, err := readLdSoConf(m)
+					if err != nil {
+						return nil, err
+					}
+					dirs = append(dirs, d...)
+				}
+			}
+		case fields[0] == "hwcap":
+		default:
+			dirs = append(dirs, fields...)
+		}
+	}
+	return dirs, s.Err()
+}
+
+// libDep is a file an ELF file needs at runtime
+type libDep struct {
+	// src is the path of the file on the build host
+	src string
+	// path is where the file must be in the image. It differs from src
+	// for libraries found relative to the file needing them ($ORIGIN).
+	path string
+}
+
+// searchDir is a directory libraries are looked for in
+type searchDir struct {
+	// src is the directory on the build host and path the same directory
+	// in the image
+	src, path string
+}
+
+// elfObject is an ELF file whose dependencies are to be resolved
+type elfObject struct {
+	libDep
+	// rpath holds the RPATH directories of the files which caused this
+	// one to be loaded, which the loader searches as well
+	rpath []searchDir
+}
+
+// deps returns the dynamic loader and all the shared libraries, recursively,
+// needed by the file at src, which is at p in the image. Files which are not
+// dynamically linked ELF files have no dependencies.
+func (r *libResolver) deps(src, p string) ([]libDep, error) {
+	if ok, err := isELF(src); !ok || err != nil {
+		return nil, err
+	}
+	f, err := elf.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	class, machine := f.Class, f.Machine
+	f.Close()
+
+	var deps []libDep
+	seen := map[string]bool{p: true}
+	queue := []elfObject{{libDep: libDep{src: src, path: p}}}
+	for len(queue) > 0 {
+		obj := queue[0]
+		queue = queue[1:]
+		needed, rpath, err := r.needed(obj, class, machine)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range needed {
+			if !seen[n.path] {
+				seen[n.path] = true
+				deps = append(deps, n)
+				queue = append(queue, elfObject{libDep: n, rpath: rpath})
+			}
+		}
+	}
+	return deps, nil
+}
+
+// needed returns the interpreter and the shared libraries directly needed by
+// the ELF file obj, along with the RPATH its own dependencies inherit
+func (r *libResolver) needed(obj elfObject, class elf.Class, machine elf.Machine) ([]libDep, []searchDir, error) {
+	f, err := elf.Open(obj.src)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var deps []libDep
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_INTERP {
+			continue
+		}
+		b := make([]byte, p.Filesz)
+		if _, err := p.ReadAt(b, 0); err != nil {
+			return nil, nil, fmt.Errorf("error reading interpreter of %s: %v", obj.src, err)
+		}
+		interp := string(bytes.TrimRight(b, "\x00"))
+		deps = append(deps, libDep{src: interp, path: interp})
+	}
+
+	// The loader only looks at the RPATH of a file, and of the files
+	// loading it, if the file has no RUNPATH
+	rpath, err := searchDirs(f, elf.DT_RPATH, obj)
+	if err != nil {
+		return nil, nil, err
+	}
+	rpath = append(rpath, obj.rpath...)
+	runpath, err := searchDirs(f, elf.DT_RUNPATH, obj)
+	if err != nil {
+		return nil, nil, err
+	}
+	var dirs []searchDir
+	if len(runpath) == 0 {
+		dirs = append(dirs, rpath...)
+	}
+	for _, d := range r.libPath {
+		dirs = append(dirs, searchDir{d, d})
+	}
+	dirs = append(dirs, runpath...)
+
+	libs, err := f.ImportedLibraries()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading dynamic section of %s: %v", obj.src, err)
+	}
+	for _, lib := range libs {
+		dep, ok, err := r.find(lib, dirs, class, machine)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			r.missing = append(r.missing, fmt.Sprintf("%s (needed by /%s)", lib, cleanRootfsPath(obj.path)))
+			continue
+		}
+		deps = append(deps, dep)
+	}
+	return deps, rpath, nil
+}
+
+// searchDirs returns the directories listed in the dynamic tag (DT_RPATH or
+// DT_RUNPATH) of the ELF file obj
+func searchDirs(f *elf.File, tag elf.DynTag, obj elfObject) ([]searchDir, error) {
+	vals, err := f.DynString(tag)
+	if err != nil {
+		return nil, fmt.Errorf("error reading dynamic section of %s: %v", obj.src, err)
+	}
+	lib := "lib"
+	if f.Class == elf.ELFCLASS64 {
+		lib = "lib64"
+	}
+	var dirs []searchDir
+	for _, v := range vals {
+		for _, d := range filepath.SplitList(v) {
+			if d == "" {
+				continue
+			}
+			d = strings.NewReplacer("${LIB}", lib, "$LIB", lib).Replace(d)
+			if !strings.Contains(d, "$ORIGIN") && !strings.Contains(d, "${ORIGIN}") {
+				dirs = append(dirs, searchDir{d, d})
+				continue
+			}
+			// $ORIGIN is the directory of the file, which is in
+			// different places on the build host and in the image
+			src, err := filepath.EvalSymlinks(obj.src)
+			if err != nil {
+				return nil, err
+			}
+			origin := strings.NewReplacer("${ORIGIN}", "$ORIGIN")
+			dirs = append(dirs, searchDir{
+				src:  strings.Replace(origin.Replace(d), "$ORIGIN", filepath.Dir(src), -1),
+				path: path.Clean("/" + strings.Replace(origin.Replace(d), "$ORIGIN", path.Dir("/"+obj.path), -1)),
+			})
+		}
+	}
+	return dirs, nil
+}
+
+// find looks for the named shared library, built for the given class and
+// machine, first in dirs, then in ld.so.cache and finally in the default
+// directories
+func (r *libResolver) find(lib string, dirs []searchDir, class elf.Class, machine elf.Machine) (libDep, bool, error) {
+	if strings.Contains(lib, "/") {
+		return libDep{src: lib, path: lib}, true, nil
+	}
+	var candidates []libDep
+	for _, d := range dirs {
+		candidates = append(candidates, libDep{filepath.Join(d.src, lib), path.Join(d.path, lib)})
+	}
+	for _, p := range r.cache[lib] {
+		candidates = append(candidates, libDep{p, p})
+	}
+	for _, d := range r.dirs {
+		candidates = append(candidates, libDep{filepath.Join(d, lib), filepath.Join(d, lib)})
+	}
+
+	for _, c := range candidates {
+		// Skip anything which isn't a shared library, e.g. the linker
+		// scripts some distributions install as libfoo.so
+		if ok, err := isELF(c.src); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return libDep{}, false, err
+		} else if !ok {
+			continue
+		}
+		f, err := elf.Open(c.src)
+		if err != nil {
+			return libDep{}, false, err
+		}
+		ok := f.Class == class && f.Machine == machine
+		f.Close()
+		if ok {
+			return c, true, nil
+		}
+	}
+	return libDep{}, false, nil
+}
+
+// multiarchDirs are the library directories Debian-based distributions
+// build into the dynamic loader for each machine, besides defaultLibDirs
+var multiarchDirs = map[elf.Machine]string{
+	elf.EM_X86_64:  "x86_64-linux-gnu",
+	elf.EM_386:     "i386-linux-gnu",
+	elf.EM_AARCH64: "aarch64-linux-gnu",
+	elf.EM_ARM:     "arm-linux-gnueabihf",
+	elf.EM_PPC64:   "powerpc64le-linux-gnu",
+	elf.EM_S390:    "s390x-linux-gnu",
+}
+
+// missingLibraries looks up the dynamic loader and shared libraries needed
+// by every ELF file in the rootfs within the rootfs itself, as the dynamic
+// loader would when the image runs, and returns those it can't find. This
+// catches libraries which were found on the build host, but not where the
+// loader looks for them in the image, as well as assets replacing them.
+func missingLibraries(fs *rootfs) ([]string, error) {
+	// The image may bring an ld.so.cache of its own
+	var cache map[string][]string
+	if p, ok := fs.resolve("/etc/ld.so.cache"); ok && fs.entries[p] != "" {
+		var err error
+		if cache, err = readLdSoCache(fs.entries[p]); err != nil {
+			return nil, err
+		}
+	}
+	var missing []string
+	for _, p := range fs.paths() {
+		src := fs.entries[p]
+		if src == "" {
+			continue
+		}
+		if info, err := os.Lstat(src); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if ok, err := isELF(src); !ok || err != nil {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		m, err := missingDeps(fs, p, src, cache)
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, m...)
+	}
+	return missing, nil
+}
+
+// missingDeps returns the dynamic loader and shared libraries directly
+// needed by the ELF file at p in the image, read from src, which are not in
+// the image
+func missingDeps(fs *rootfs, p, src string, cache map[string][]string) ([]string, error) {
+	f, err := elf.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var missing []string
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		b := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(b, 0); err != nil {
+			return nil, fmt.Errorf("error reading interpreter of %s: %v", src, err)
+		}
+		interp := string(bytes.TrimRight(b, "\x00"))
+		if _, ok := fs.resolve(interp); !ok {
+			missing = append(missing, fmt.Sprintf("%s (dynamic loader of /%s)", interp, p))
+		}
+	}
+
+	obj := elfObject{libDep: libDep{src: src, path: p}}
+	rpath, err := searchDirs(f, elf.DT_RPATH, obj)
+	if err != nil {
+		return nil, err
+	}
+	runpath, err := searchDirs(f, elf.DT_RUNPATH, obj)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	if len(runpath) == 0 {
+		for _, d := range rpath {
+			dirs = append(dirs, d.path)
+		}
+	}
+	for _, d := range runpath {
+		dirs = append(dirs, d.path)
+	}
+
+	libs, err := f.ImportedLibraries()
+	if err != nil {
+		return nil, fmt.Errorf("error reading dynamic section of %s: %v", src, err)
+	}
+	for _, lib := range libs {
+		var candidates []string
+		if strings.Contains(lib, "/") {
+			candidates = []string{lib}
+		} else {
+			for _, d := range dirs {
+				candidates = append(candidates, path.Join(d, lib))
+			}
+			candidates = append(candidates, cache[lib]...)
+			for _, d := range defaultLibDirs {
+				candidates = append(candidates, path.Join(d, lib))
+			}
+			if triplet, ok := multiarchDirs[f.Machine]; ok {
+				candidates = append(candidates, path.Join("/lib", triplet, lib), path.Join("/usr/lib", triplet, lib))
+			}
+		}
+		found := false
+		for _, c := range candidates {
+			if found, err = imageHasLib(fs, c, f.Class, f.Machine); found || err != nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			missing = append(missing, fmt.Sprintf("%s (needed by /%s)", lib, p))
+		}
+	}
+	return missing, nil
+}
+
+// imageHasLib reports whether p is a shared library in the image, built for
+// the given class and machine
+func imageHasLib(fs *rootfs, p string, class elf.Class, machine elf.Machine) (bool, error) {
+	p, ok := fs.resolve(p)
+	if !ok || fs.entries[p] == "" {
+		return false, nil
+	}
+	src := fs.entries[p]
+	if ok, err := isELF(src); !ok || err != nil {
+		return false, err
+	}
+	f, err := elf.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return f.Class == class && f.Machine == machine, nil
+}
+
+// elfArch is what the ELF header of a file built for a GOARCH says
+type elfArch struct {
+	class   elf.Class
+	data    elf.Data
+	machine elf.Machine
+}
+
+// elfArchs maps the values of the arch label of images to the ELF files
+// which run on that architecture
+var elfArchs = map[string]elfArch{
+	"386":      {elf.ELFCLASS32, elf.ELFDATA2LSB, elf.EM_386},
+	"amd64":    {elf.ELFCLASS64, elf.ELFDATA2LSB, elf.EM_X86_64},
+	"arm":      {elf.ELFCLASS32, elf.ELFDATA2LSB, elf.EM_ARM},
+	"arm64":    {elf.ELFCLASS64, elf.ELFDATA2LSB, elf.EM_AARCH64},
+	"ppc64":    {elf.ELFCLASS64, elf.ELFDATA2MSB, elf.EM_PPC64},
+	"ppc64le":  {elf.ELFCLASS64, elf.ELFDATA2LSB, elf.EM_PPC64},
+	"riscv64":  {elf.ELFCLASS64, elf.ELFDATA2LSB, elf.EM_RISCV},
+	"s390x":    {elf.ELFCLASS64, elf.ELFDATA2MSB, elf.EM_S390},
+	"mips":     {elf.ELFCLASS32, elf.ELFDATA2MSB, elf.EM_MIPS},
+	"mipsle":   {elf.ELFCLASS32, elf.ELFDATA2LSB, elf.EM_MIPS},
+	"mips64":   {elf.ELFCLASS64, elf.ELFDATA2MSB, elf.EM_MIPS},
+	"mips64le": {elf.ELFCLASS64, elf.ELFDATA2LSB, elf.EM_MIPS},
+}
+
+// elfOSABIs maps the values of the os label of images to the OS ABIs of the
+// ELF files which run on that system. Most Linux files say nothing about
+// their OS ABI, i.e. System V, unless they use GNU extensions.
+var elfOSABIs = map[string][]elf.OSABI{
+	"linux":   {elf.ELFOSABI_NONE, elf.ELFOSABI_LINUX},
+	"freebsd": {elf.ELFOSABI_NONE, elf.ELFOSABI_FREEBSD},
+}
+
+// foreignFiles returns the ELF files in the rootfs which are not built for
+// the os and arch of the image, with what they are built for. Files built for
+// an os or arch goaci knows nothing about are not reported.
+func foreignFiles(fs *rootfs, goos, goarch string) ([]string, error) {
+	want, knownArch := elfArchs[goarch]
+	abis, knownOS := elfOSABIs[goos]
+	var foreign []string
+	for _, p := range fs.paths() {
+		src := fs.entries[p]
+		if src == "" {
+			continue
+		}
+		if info, err := os.Lstat(src); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if ok, err := isELF(src); !ok || err != nil {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		f, err := elf.Open(src)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", src, err)
+		}
+		got := elfArch{f.Class, f.Data, f.Machine}
+		abi := f.OSABI
+		f.Close()
+		if knownArch && got != want {
+			what := got.machine.String()
+			if got.machine == want.machine {
+				what += fmt.Sprintf(" (%s, %s)", got.class, got.data)
+			}
+			foreign = append(foreign, fmt.Sprintf("/%s is built for %s, not %s", p, what, goarch))
+		}
+		if knownOS && !hasOSABI(abis, abi) {
+			foreign = append(foreign, fmt.Sprintf("/%s is built for %s, not %s", p, abi, goos))
+		}
+	}
+	return foreign, nil
+}
+
+func hasOSABI(abis []elf.OSABI, abi elf.OSABI) bool {
+	for _, a := range abis {
+		if a == abi {
+			return true
+		}
+	}
+	return false
+}
+
+// dynamicLinking returns what makes the ELF file at path dynamically linked:
+// a dynamic loader to run it or a dynamic section. It returns "" for
+// statically linked files and for files which are not ELF files.
+func dynamicLinking(path string) (string, error) {
+	if ok, err := isELF(path); !ok || err != nil {
+		return "", err
+	}
+	f, err := elf.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_INTERP {
+			return "it needs a dynamic loader", nil
+		}
+	}
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_DYNAMIC {
+			return "it has a dynamic section", nil
+		}
+	}
+	return "", nil
+}
+
+// isELF reports whether the file at path starts with the ELF magic number
+func isELF(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	b := make([]byte, len(elf.ELFMAG))
+	if _, err := io.ReadFull(f, b); err != nil {
+		return false, nil
+	}
+	return string(b) == elf.ELFMAG, nil
+}
+
+// addLibraryDeps adds the dynamic loader and shared libraries needed by the
+// ELF files in the rootfs
+func addLibraryDeps(fs *rootfs, r *libResolver) error {
+	for _, p := range fs.paths() {
+		src := fs.entries[p]
+		if src == "" {
+			continue
+		}
+		if info, err := os.Lstat(src); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		deps, err := r.deps(src, p)
+		if err != nil {
+			return err
+		}
+		for _, d := range deps {
+			if fs.has(d.path) {
+				continue
+			}
+			real, err := filepath.EvalSymlinks(d.src)
+			if err != nil {
+				return err
+			}
+			debug("adding library needed by ", p, ": ", d.path)
+			fs.addDep(d.path, real)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"debug/elf"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// dynamicBinary returns the path of a dynamically linked program of the
+// build host, skipping the test if there is none
+func dynamicBinary(t *testing.T) string {
+	for _, p := range []string{"/bin/ls", "/bin/sh", "/usr/bin/env"} {
+		f, err := elf.Open(p)
+		if err != nil {
+			continue
+		}
+		for _, prog := range f.Progs {
+			if prog.Type == elf.PT_INTERP {
+				f.Close()
+				return p
+			}
+		}
+		f.Close()
+	}
+	t.Skip("no dynamically linked program to test with")
+	return ""
+}
+
+func TestMissingLibraries(t *testing.T) {
+	bin := dynamicBinary(t)
+	fs := newRootfs()
+	fs.add("bin/app", bin)
+	missing, err := missingLibraries(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loader := false
+	for _, m := range missing {
+		loader = loader || strings.HasSuffix(m, "(dynamic loader of /bin/app)")
+	}
+	if !loader || len(missing) < 2 {
+		t.Errorf("missing from an image without libraries: %q, want the dynamic loader and libraries", missing)
+	}
+
+	libs, err := newLibResolver(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := addLibraryDeps(fs, libs); err != nil {
+		t.Fatal(err)
+	}
+	if missing, err = missingLibraries(fs); err != nil || len(missing) != 0 {
+		t.Errorf("missing from an image with the libraries added: %q, %v", missing, err)
+	}
+}
+
+func TestForeignFiles(t *testing.T) {
+	bin := dynamicBinary(t)
+	fs := newRootfs()
+	fs.add("bin/app", bin)
+	other := "arm64"
+	if runtime.GOARCH == other {
+		other = "amd64"
+	}
+	tests := []struct {
+		goos, goarch string
+		foreign      bool
+	}{
+		{runtime.GOOS, runtime.GOARCH, false},
+		{runtime.GOOS, other, true},
+		// Nothing is known about these
+		{runtime.GOOS, "sparc64", false},
+		{"plan9", runtime.GOARCH, false},
+	}
+	for _, tt := range tests {
+		foreign, err := foreignFiles(fs, tt.goos, tt.goarch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(foreign) != 0) != tt.foreign {
+			t.Errorf("foreignFiles for %s/%s = %q, want foreign files %v", tt.goos, tt.goarch, foreign, tt.foreign)
+		}
+	}
+}
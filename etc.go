@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// addStubEtc generates minimal /etc/passwd, /etc/group, /etc/nsswitch.conf
+// and /etc/resolv.conf files in dir, knowing about root and the user and
+// group the app runs as, and adds those which the rootfs doesn't have yet.
+// Many programs, and glibc's name resolution, misbehave without them.
+func addStubEtc(fs *rootfs, dir, user, group string) error {
+	passwd := "root:x:0:0:root:/:/sbin/nologin\n"
+	groups := "root:x:0:\n"
+	gid := "0"
+	if _, err := strconv.Atoi(group); err == nil && group != "0" {
+		gid = group
+		groups += fmt.Sprintf("app:x:%s:\n", group)
+	}
+	if _, err := strconv.Atoi(user); err == nil && user != "0" {
+		passwd += fmt.Sprintf("app:x:%s:%s:app:/:/sbin/nologin\n", user, gid)
+	}
+
+	files := []struct {
+		name, contents string
+	}{
+		{"passwd", passwd},
+		{"group", groups},
+		{"nsswitch.conf", "passwd: files\ngroup: files\nshadow: files\nhosts: files dns\nnetworks: files\nprotocols: files\nservices: files\n"},
+		{"resolv.conf", "# Replaced by the container runtime when it configures DNS\n"},
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, f := range files {
+		p := "etc/" + f.name
+		if fs.has(p) {
+			debug("not replacing /", p, " from assets")
+			continue
+		}
+		src := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(src, []byte(f.contents), 0644); err != nil {
+			return err
+		}
+		fs.add(p, src)
+	}
+	return nil
+}
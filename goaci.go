@@ -1,44 +1,246 @@
 package main
 
 // TODO(jonboulle): at a bare minimum, allow user to specify arguments to exec
-// TODO(jonboulle): allow user to add assets to the ACI
-// TODO(jonboulle): support user-specified GOPATHs/local packages. Right now we pull down a fresh copy of the specified package every time. This is better in terms of isolation and reproducibility, but inconvenient.
-// TODO(jonboulle): add git SHA as a label in the image manifest
 // TODO(jonboulle): support passing user-supplied arguments to `go get`? this might be tricky as we need to set a lot ourselves, and what if they conflict?
-// TODO(jonboulle): support multiple executables?
 
 import (
 	"archive/tar"
 	"bytes"
-	"compress/gzip"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/appc/spec/aci"
 	"github.com/appc/spec/schema"
 	"github.com/appc/spec/schema/types"
 )
 
-var Debug bool
+var (
+	Debug bool
+	// Quiet silences warnings and the output of the commands goaci runs,
+	// leaving only errors and the results of the build
+	Quiet   bool
+	verbose bool
+
+	logFormat       = flag.String("log-format", "text", "how to report what goaci does: text or json, for one JSON object per line")
+	cpuProfile      = flag.String("cpuprofile", "", "write a CPU profile of goaci to this file, for go tool pprof")
+	memProfile      = flag.String("memprofile", "", "write a memory profile of goaci to this file when it exits, for go tool pprof")
+	logFilePath     = flag.String("log-file", "", "file to append everything goaci reports to, including the output of the commands it runs, as well as printing it")
+	discoveryNaming = flag.Bool("discovery-naming", false, "name the output file {name}-{version}-{os}-{arch}.aci, following the appc discovery template")
+	imageVersion    = flag.String("image-version", "latest", "value of the version label of the image")
+	compression     = flag.String("compression", "gzip", "compression of the image: gzip, xz or none")
+	compressionLvl  = flag.Int("compression-level", 0, "compression level from 1 (fastest) to 9 (smallest); 0 uses the default of the compression")
+	sourceDateEpoch = flag.Int64("source-date-epoch", -1, "modification time, in seconds since the epoch, recorded for all files in the image; defaults to $SOURCE_DATE_EPOCH, or 0")
+	preserveOwner   = flag.Bool("preserve-ownership", false, "record the uid and gid of files as they are in the build directory, instead of root")
+	includeTzdata   = flag.Bool("include-tzdata", false, "add the timezone database of the build host to the image, in /usr/share/zoneinfo")
+	stubEtc         = flag.Bool("stub-etc", false, "add minimal /etc/passwd, /etc/group, /etc/nsswitch.conf and /etc/resolv.conf files to the image, unless assets provide them")
+	rewriteSymlinks = flag.Bool("rewrite-absolute-symlinks", false, "turn absolute symlinks in the image into relative ones, so they stay within the image when it is extracted")
+	jobs            = flag.Int("jobs", 0, "how many packages go builds, and how many parts of the image are compressed, in parallel; by default go builds as many packages as there are CPUs")
+	buildImage      = flag.String("build-in-container", "", "docker image to run go in, instead of the go of the host, so that neither the host's go nor its environment affect the build")
+	cacheDir        = flag.String("cache-dir", "", "directory to keep the GOPATH, module cache and build cache in between builds, instead of starting from scratch every time")
+	cgo             = flag.Bool("cgo", false, "build with cgo, and add the shared libraries the binary needs to the image; unless -go-tags is given, netgo is not used either")
+	ignoreMissing   = flag.Bool("ignore-missing-libs", false, "only warn about shared libraries needed by files in the image which can't be found, on the build host or within the image, instead of failing")
+	strictArch      = flag.Bool("strict-arch", false, "fail instead of warning when ELF files in the image, e.g. assets, are built for another architecture or OS than the image")
+	allowDynamic    = flag.Bool("allow-dynamic", false, "without -cgo, only warn instead of failing when go builds a dynamically linked binary, e.g. because cgo is enabled through -build-env")
+	goTags          = flag.String("go-tags", "netgo", "build tags to pass to go")
+	goLdflags       = flag.String("go-ldflags", "-w", "flags to pass to the go linker, e.g. '-w -X main.version=1.0'")
+	noValidate      = flag.Bool("no-validate", false, "don't check ACIs against the app container specification once they are written")
+	ciAnnots        = flag.Bool("ci-annotations", false, "record the CI job building the image, read from the variables set by GitHub Actions, GitLab CI, Travis CI, CircleCI, Buildkite or Jenkins, as annotations")
+	forbidDirty     = flag.Bool("forbid-dirty", false, "fail if the project has uncommitted changes, instead of only warning and marking its revision as dirty")
+	expectCommit    = flag.String("expect-commit", "", "hash of the commit (or at least its first 12 hex digits) the project must be at once fetched, and checked out with -revision, without uncommitted changes; the build fails otherwise")
+	revision        = flag.String("revision", "", "branch, tag or commit of the project to build, instead of the head of its default branch; the project must be a git repository")
+	sourceSHA256    = flag.String("source-sha256", "", "sha256 the source archive must have, instead of pinning it with a #sha256= fragment of its URL")
+	localSource     = flag.String("local-source", "", "directory holding the source of the package, to build instead of fetching it. Directories in a module are built in place, others are linked into the temporary GOPATH. The package may also be given as a directory, if it is part of a module")
+	stampVersion    = flag.String("stamp-version", "", "string variable, as <package path>.<name>, to set to the version of the project according to git describe; that version is also used as -image-version unless one is given")
+	reproducible    = flag.Bool("reproducible", false, "build the binary without the paths it was built in and with an empty build ID, so that building the same source twice gives the same binary")
+	goGenerate      = flag.Bool("go-generate", false, "run go generate ./... in the project before building it")
+	runTests        = flag.Bool("run-tests", false, "run the tests of the package after building it, and stop if they fail")
+	allBinaries     = flag.Bool("all-binaries", false, "build an image for every binary the package builds, e.g. for example.com/tools/..., named after the package and the binary")
+	goProxy         = flag.String("go-proxy", "", "module proxies to use, as GOPROXY")
+	goPrivate       = flag.String("go-private", "", "patterns of module paths to fetch directly instead of through a proxy, as GOPRIVATE")
+	useVendor       = flag.Bool("use-vendor", false, "build against the project's vendor directory only, so that nothing but the project itself is fetched")
+	skipSpecial     = flag.Bool("skip-special-files", false, "leave devices and FIFOs out of assets, instead of recreating them in the image")
+	preserveAttrs   = flag.Bool("preserve-attrs", false, "keep the owner, modification time and setuid, setgid and sticky bits of files; implies -preserve-ownership")
+	signKey         = flag.String("sign-key", "", "ID of the gpg key to sign the image with; the signature is written next to the image, with an .asc extension")
+	gpgHomedir      = flag.String("gpg-homedir", "", "gpg home directory to look up the signing key in")
+	checksum        = flag.Bool("checksum", false, "write the sha512 of the image next to it, with a .sha512 extension, and print the key of the image in the rkt store")
+	splitDeps       = flag.Bool("split-deps", false, "put the shared libraries and script interpreters goaci adds to the image into a separate ACI, named after their contents, which the image depends on, so that images needing the same ones share that ACI")
+	outputDir       = flag.String("output-dir", "", "write the image as a directory holding the manifest and rootfs, instead of as an archive")
+	verify          = flag.Bool("verify-rootfs", false, "check that the program of the image runs in its rootfs, with the loader and libraries of the image, by running it with --version or --help in a chroot (which needs root)")
+	linkAssets      = flag.Bool("link-assets", false, "with -output-dir, hard link the files of the image to where they are read from instead of copying them, if they are on the same filesystem; changing them then changes the image, too")
+	updateOutput    = flag.Bool("update", false, "with -output-dir, update an image directory written before in place, only copying the files which changed")
+	importIntoRkt   = flag.Bool("import-into-rkt", false, "fetch the image into the local rkt store after writing it")
+	push            = flag.String("push", "", "upload the image, and its signature and checksum, to this http(s), s3 or gs URL; if it ends with a slash, the image keeps its file name")
+	format          = flag.String("format", "aci", "output format: aci, oci (OCI image layout directory), oci-archive (OCI image layout tarball) or docker (tarball for docker load)")
+	output          string
+	assets          stringVector
+	assetExcludes   stringVector
+	libPath         stringVector
+	defines         stringVector
+	assetHooks      stringVector
+	chmods          stringVector
+	patches         stringVector
+	buildEnv        stringVector
+	makeDirs        stringVector
+)
+
+func init() {
+	flag.Var(&assets, "asset", "file or directory to add to the image, as <path on host>:<path in image>; the host path may contain wildcards (with ** matching any number of directories), in which case the image path is the directory to place the matches in. Can be given multiple times")
+	flag.Var(&libPath, "lib-path", "colon separated list of directories to search for the shared libraries needed by files in the image before any others, like LD_LIBRARY_PATH. Can be given multiple times")
+	flag.Var(&defines, "define", "define a placeholder for -asset and -asset-exclude, as NAME=value, making <NAME> stand for value. Can be given multiple times")
+	flag.Var(&assetHooks, "asset-hook", "shell command to run on a copy of every regular file of the assets before it is added to the image, with {} standing for the file, e.g. 'strip {}'. Can be given multiple times")
+	flag.Var(&makeDirs, "make-dir", "empty directory to create in the image, as <path in image>[:<octal mode>], e.g. /var/lib/myapp:0700. Can be given multiple times")
+	flag.Var(&buildEnv, "build-env", "variable to set in the environment of go, as NAME=value, e.g. CC=clang with -cgo. Can be given multiple times")
+	flag.Var(&patches, "patch", "patch to apply to the source of the project before building it, with git apply in git repositories and patch -p1 otherwise. Can be given multiple times")
+	flag.Var(&chmods, "chmod", "permissions to give a path in the image, as <path in image>=<octal mode>, e.g. /etc/myapp.conf=0600 or /bin/helper=4755. Can be given multiple times")
+	flag.Var(&assetExcludes, "asset-exclude", "path or pattern, like the host path of -asset, of files to leave out of the assets; directories are left out with all their contents. Can be given multiple times")
+
+	const usage = "path to write the image to; if it is a directory, the image is written there under its default name"
+	flag.StringVar(&output, "o", "", usage)
+	flag.StringVar(&output, "output", "", usage)
+
+	const vusage = "report in detail what goaci does, like setting GOACI_DEBUG"
+	flag.BoolVar(&verbose, "v", false, vusage)
+	flag.BoolVar(&verbose, "verbose", false, vusage)
+	flag.BoolVar(&Debug, "debug", false, "print debug messages, like setting GOACI_DEBUG")
+	flag.BoolVar(&Quiet, "quiet", false, "only report errors, progress and the files written, leaving out warnings, the phases of the build and the output of the commands goaci runs (except for their errors)")
+}
+
+// goos and goarch are the platform go builds for, which the images are
+// labelled with and checked against
+var goos, goarch = runtime.GOOS, runtime.GOARCH
+
+// passedEnv are the variables of goaci's environment go gets as well, so
+// that it can reach the network through proxies and authenticate to private
+// repositories, with the user's ~/.netrc, ssh keys or agent and git settings
+var passedEnv = []string{
+	"HOME",
+	"NETRC",
+	"SSH_AUTH_SOCK",
+	"GIT_SSH_COMMAND",
+	"GIT_ASKPASS",
+	"http_proxy", "https_proxy", "no_proxy",
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY",
+}
+
+// formatExts maps the supported output formats to the extension of the
+// default output name
+var formatExts = map[string]string{
+	"aci":         ".aci",
+	"oci":         ".oci",
+	"oci-archive": ".oci.tar",
+	"docker":      ".docker.tar",
+}
 
 func die(s string, i ...interface{}) {
 	s = fmt.Sprintf(s, i...)
-	fmt.Fprintln(os.Stderr, strings.TrimSuffix(s, "\n"))
+	if ctx.Err() != nil {
+		// Whatever failed was stopped by the interrupt
+		s = "interrupted"
+	}
+	reportError("%s", s)
+	runCleanups()
 	os.Exit(1)
 }
 
+// reportError reports an error like die, without exiting
+func reportError(s string, i ...interface{}) {
+	s = fmt.Sprintf(s, i...)
+	if logJSON {
+		emit(stderr, logEvent{Level: "error", Msg: s})
+		return
+	}
+	logLine(stderr, s)
+}
+
+func warn(s string, i ...interface{}) {
+	w := stderr
+	if Quiet {
+		// The log file gets it all the same
+		if logFile == nil {
+			return
+		}
+		w = logFile
+	}
+	s = fmt.Sprintf(s, i...)
+	if logJSON {
+		emit(w, logEvent{Level: "warning", Msg: s})
+		return
+	}
+	logLine(w, "warning: "+s)
+}
+
 func debug(i ...interface{}) {
 	if Debug {
 		s := fmt.Sprint(i...)
-		fmt.Fprintln(os.Stderr, strings.TrimSuffix(s, "\n"))
+		if logJSON {
+			emit(stderr, logEvent{Level: "debug", Msg: s})
+			return
+		}
+		logLine(stderr, s)
 	}
 }
 
+// commands are run instead of building an image when their name is the first
+// argument, and get the arguments following it
+var commands = map[string]func(args []string){
+	"version": runVersion,
+}
+
+// commandFlags returns the flags given before the command whose arguments
+// are args, for commands running goaci again
+func commandFlags(args []string) []string {
+	return append([]string(nil), os.Args[1:len(os.Args)-len(args)-1]...)
+}
+
 func main() {
+	if os.Getenv("GOACI_DEBUG") != "" {
+		Debug = true
+	}
+	flag.Parse()
+	switch *logFormat {
+	case "text":
+	case "json":
+		logJSON = true
+	default:
+		die("unknown log format %q", *logFormat)
+	}
+	if *logFilePath != "" {
+		if err := openLogFile(*logFilePath); err != nil {
+			die("error opening log file: %v", err)
+		}
+		defer logFile.Close()
+	}
+	if verbose {
+		Debug = true
+	}
+	if Debug && Quiet {
+		die("-quiet can't be combined with -verbose, -debug or GOACI_DEBUG")
+	}
+	if args := flag.Args(); len(args) > 0 {
+		if cmd, ok := commands[args[0]]; ok {
+			cmd(args[1:])
+			return
+		}
+	}
+	if err := startProfiling(*cpuProfile, *memProfile); err != nil {
+		die("error starting profiling: %v", err)
+	}
+	defer runCleanups()
 	if os.Getenv("GOPATH") != "" {
 		die("to avoid confusion GOPATH must not be set")
 	}
@@ -46,81 +248,461 @@ func main() {
 	if goroot == "" {
 		die("GOROOT must be set")
 	}
-	if os.Getenv("GOACI_DEBUG") != "" {
-		Debug = true
+	ext, ok := formatExts[*format]
+	if !ok {
+		die("unknown format %q", *format)
+	}
+	if err := checkCompression(*compression, *compressionLvl); err != nil {
+		die(err.Error())
+	}
+	if *format != "aci" && *compression == "xz" {
+		die("xz compression is only supported for ACIs")
+	}
+	if *format == "oci" && (*signKey != "" || *checksum) {
+		die("can't sign or checksum an OCI image layout, as it is a directory")
+	}
+	if *splitDeps && (*format != "aci" || *outputDir != "") {
+		die("-split-deps only works with ACI archives")
+	}
+	if *outputDir != "" && (*format != "aci" || output != "" || *signKey != "" || *checksum) {
+		die("-output-dir can't be combined with -format, -output, -sign-key or -checksum")
+	}
+	if (*updateOutput || *linkAssets) && *outputDir == "" {
+		die("-update and -link-assets only work with -output-dir")
+	}
+	if *importIntoRkt && (*format != "aci" || *outputDir != "") {
+		die("-import-into-rkt only works with ACI archives")
+	}
+	if *push != "" && (*format == "oci" || *outputDir != "") {
+		die("-push can't upload image directories")
+	}
+	if *splitDeps && *push != "" && !strings.HasSuffix(*push, "/") {
+		die("with -split-deps, the -push URL must end with a slash, so that the image and its dependencies keep their file names")
+	}
+	if len(patches) > 0 && *cacheDir != "" {
+		die("-patch can't be combined with -cache-dir, as it would change the cached source")
+	}
+	if *buildImage != "" && *cgo {
+		die("-build-in-container can't be combined with -cgo, as the libraries the binary needs are taken from the host")
+	}
+	if *verify && os.Geteuid() != 0 {
+		die("-verify-rootfs needs to be run as root, to chroot")
+	}
+	if *jobs < 0 {
+		die("-jobs must not be negative")
+	}
+	compressJobs = *jobs
+	if *useVendor && *goProxy != "" {
+		die("-use-vendor can't be combined with -go-proxy")
+	}
+	// Both end up where they could smuggle in more: the variable in the
+	// linker flags, the version in the name of the output file
+	if *stampVersion != "" && !stampVarRE.MatchString(*stampVersion) {
+		die("bad -stamp-version %q: must be of the form <package path>.<name>", *stampVersion)
+	}
+	// Any shorter, and a prefix pins next to nothing
+	if *expectCommit != "" && !commitRE.MatchString(*expectCommit) {
+		die("bad -expect-commit %q: must be the hash of the commit, or at least its first 12 hex digits", *expectCommit)
+	}
+	if err := checkImageVersion(*imageVersion); err != nil {
+		die("bad -image-version: %v", err)
+	}
+	mtime, err := buildTime()
+	if err != nil {
+		die("bad source date epoch: %v", err)
+	}
+	topts := tarOptions{
+		mtime:             mtime,
+		preserveOwnership: *preserveOwner || *preserveAttrs,
+		preserveTimes:     *preserveAttrs,
 	}
 
+	// From now on an interrupt stops what is running, and the
+	// temporary directory is removed
+	handleInterrupts()
+	endPhase := phase("setup")
 	// Set up a temporary directory for everything (gopath and builds)
 	tmpdir, err := ioutil.TempDir("", "goaci")
 	if err != nil {
 		die("error setting up temporary directory: %v", err)
 	}
-	defer os.RemoveAll(tmpdir)
-
-	// Scratch build dir for aci
-	acidir := filepath.Join(tmpdir, "aci")
+	atExit(func() { os.RemoveAll(tmpdir) })
 
 	// Be explicit with gobin
 	gobin := filepath.Join(tmpdir, "bin")
 
-	// Find the go binary
-	gocmd, err := exec.LookPath("go")
-	if err != nil {
-		die("could not find `go` in path")
+	// Everything go downloads and builds is thrown away with tmpdir,
+	// unless it is to be kept in the cache directory
+	gopath, gocache := tmpdir, filepath.Join(tmpdir, "cache")
+	if *cacheDir != "" {
+		if gopath, err = filepath.Abs(filepath.Join(*cacheDir, "gopath")); err != nil {
+			die("bad cache directory: %v", err)
+		}
+		gocache = filepath.Join(filepath.Dir(gopath), "build")
 	}
 
-	// Construct args for a go get that does a static build
+	// Find the go binary, unless the go of the container is used
+	gocmd := "go"
+	if *buildImage == "" {
+		if gocmd, err = exec.LookPath("go"); err != nil {
+			die("could not find `go` in path")
+		}
+	} else {
+		if _, err := exec.LookPath("docker"); err != nil {
+			die("could not find `docker` in path")
+		}
+		containerMounts = []string{tmpdir}
+		if *cacheDir != "" {
+			containerMounts = append(containerMounts, filepath.Dir(gopath))
+		}
+	}
+
+	// Construct args for a go get that does a static build, unless cgo is
+	// wanted: then the pure go resolver of netgo is left out by default
+	// and the shared libraries the binary needs are added to the image
+	// like those of any other file
 	// TODO(jonboulle): go version 1.4
+	tags := *goTags
+	if *cgo && !flagSet("go-tags") {
+		tags = ""
+	}
 	args := []string{
 		gocmd,
 		"get",
 		"-a",
-		"-tags", "netgo",
-		"-ldflags", "'-w'",
+		"-tags", tags,
+	}
+	if *cacheDir != "" {
+		// Don't rebuild what is cached; the build cache tells builds
+		// with different tags and flags apart anyway
+		args = append(args[:2], args[3:]...)
 	}
 
 	// Extract the package name (which is the last arg).
 	var ns string
-	for _, arg := range os.Args[1:] {
+	for _, arg := range flag.Args() {
 		// TODO(jonboulle): try to pass the other args on to go get?
 		//		args = append(args, arg)
 		ns = arg
 	}
+	// Local sources are built in place if they are part of a module, and
+	// otherwise from the temporary GOPATH
+	src := *localSource
+	if isSourceURL(ns) {
+		if src != "" {
+			die("-local-source can't be combined with a source archive")
+		}
+		src, ns = ns, ""
+	}
+	archive := isSourceURL(src)
+	if *revision != "" && (src != "" || isLocalPath(ns)) {
+		die("-revision can't be used with local sources or source archives")
+	}
+	if len(patches) > 0 && ((src != "" && !archive) || isLocalPath(ns)) {
+		die("-patch can't be used with local sources")
+	}
+	if *sourceSHA256 != "" && !archive {
+		die("-source-sha256 only works with source archives")
+	}
+	if *expectCommit != "" && archive {
+		die("-expect-commit can't be used with source archives; pin them with -source-sha256")
+	}
+	if isLocalPath(ns) {
+		if src != "" {
+			die("-local-source can't be combined with a package directory")
+		}
+		src, ns = ns, ""
+	}
+	// A trailing /... stands for all the packages below the directory
+	all := ""
+	if strings.HasSuffix(src, "/...") {
+		src, all = strings.TrimSuffix(src, "/..."), "/..."
+	}
+	inModule := false
+	if src != "" {
+		if archive {
+			// Archives are built like local sources once unpacked
+			if src, err = fetchSource(src, *sourceSHA256, filepath.Join(tmpdir, "source")); err != nil {
+				die("error fetching source: %v", err)
+			}
+		} else if src, err = filepath.Abs(src); err != nil {
+			die("bad source directory: %v", err)
+		}
+		var root, modPath string
+		if root, modPath, inModule, err = findModule(src); err != nil {
+			die("error reading go.mod: %v", err)
+		}
+		// The package to build may be anywhere in an archived module
+		if archive && inModule && ns != "" {
+			pkg := strings.TrimSuffix(ns, "/...")
+			if pkg != modPath && !strings.HasPrefix(pkg, modPath+"/") {
+				die("%s is not part of the module %s in the source archive", pkg, modPath)
+			}
+			src = filepath.Join(root, filepath.FromSlash(strings.TrimPrefix(pkg, modPath)))
+		}
+		// The whole module is needed to build the package; archives
+		// are in the temporary directory, which is mounted anyway
+		if !inModule {
+			root = src
+		}
+		if *buildImage != "" && !archive {
+			containerMounts = append(containerMounts, root)
+		}
+		if ns == "" {
+			if ns, err = localPackage(src); err != nil {
+				die(err.Error())
+			}
+			ns += all
+		}
+	}
+	projpath := filepath.Join(gopath, "src", filepath.FromSlash(strings.TrimSuffix(ns, "/...")))
+	target := ns
+	if inModule {
+		args[1] = "install"
+		target = "."
+		if strings.HasSuffix(ns, "/...") {
+			target = "./..."
+		}
+	}
+	// Builds running at once, like those of goaci batch, share the GOPATH
+	// of the cache directory, which go get and the links to local
+	// sources change, and which assets may be taken from; so it is theirs
+	// alone until they exit. Module builds only share the module and
+	// build caches, which go locks itself.
+	if *cacheDir != "" && !inModule {
+		if err := os.MkdirAll(*cacheDir, 0755); err != nil {
+			die("error creating the cache directory: %v", err)
+		}
+		unlock, err := lockFile(filepath.Join(*cacheDir, "gopath.lock"))
+		if err != nil {
+			die("error locking the cache directory: %v", err)
+		}
+		atExit(unlock)
+	}
+	if src != "" {
+		if !inModule {
+			if err := os.MkdirAll(filepath.Dir(projpath), 0755); err != nil {
+				die("error setting up GOPATH: %v", err)
+			}
+			// The link may be left over from a previous build
+			// using the same cache directory
+			if fi, err := os.Lstat(projpath); err == nil {
+				if fi.Mode()&os.ModeSymlink == 0 {
+					die("%s is in the way of the local source", projpath)
+				}
+				if err := os.Remove(projpath); err != nil {
+					die("error setting up GOPATH: %v", err)
+				}
+			}
+			if err := os.Symlink(src, projpath); err != nil {
+				die("error setting up GOPATH: %v", err)
+			}
+		}
+		projpath = src
+	}
 
-	name, err := types.NewACName(ns)
-	// TODO(jonboulle): could this ever actually happen?
-	if err != nil {
-		die("bad app name: %v", err)
+	var name *types.ACName
+	if !*allBinaries {
+		name, err = types.NewACName(ns)
+		// TODO(jonboulle): could this ever actually happen?
+		if err != nil {
+			die("bad app name: %v", err)
+		}
 	}
 
+	env := []string{
+		"GOPATH=" + gopath,
+		"GOBIN=" + gobin,
+		"GOCACHE=" + gocache,
+		"GOROOT=" + goroot,
+		"CGO_ENABLED=0",
+		"PATH=" + os.Getenv("PATH"),
+	}
+	for _, v := range passedEnv {
+		if val, ok := os.LookupEnv(v); ok {
+			env = append(env, v+"="+val)
+		}
+	}
+	if *goProxy != "" {
+		env = append(env, "GOPROXY="+*goProxy)
+	}
+	if *goPrivate != "" {
+		env = append(env, "GOPRIVATE="+*goPrivate)
+	}
+	if *cgo {
+		env = append(env, "CGO_ENABLED=1")
+	}
+	for _, e := range buildEnv {
+		if !strings.Contains(e, "=") || strings.HasPrefix(e, "=") {
+			die("bad -build-env %q: must be of the form NAME=value", e)
+		}
+		env = append(env, e)
+	}
+	var goflags []string
+	if *useVendor {
+		// GO15VENDOREXPERIMENT for go 1.5, -mod=vendor for module
+		// builds, and no module proxy so that nothing else is fetched
+		env = append(env, "GO15VENDOREXPERIMENT=1", "GOPROXY=off")
+		goflags = append(goflags, "-mod=vendor")
+	}
+	if inModule {
+		// The module cache ends up in the temporary GOPATH, which has
+		// to be removable
+		env = append(env, "GO111MODULE=on")
+		goflags = append(goflags, "-modcacherw")
+	}
+	if len(goflags) > 0 {
+		env = append(env, "GOFLAGS="+strings.Join(goflags, " "))
+	}
+	debug("env:", env)
+	// The images are for the platform go builds for, which the
+	// environment or the container may set
+	if goos, goarch, err = goTarget(gocmd, env); err != nil {
+		die("error running go env: %v", err)
+	}
+	debug("building for ", goos, "/", goarch)
+
 	// Use the last component, e.g. example.com/my/app --> app
-	ofn := filepath.Base(ns) + ".aci"
-	mode := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
-	of, err := os.OpenFile(ofn, mode, 0644)
-	if err != nil {
-		die("error opening output file: %v", err)
+	base := filepath.Base(strings.TrimSuffix(ns, "/..."))
+	var ofn string
+	var of *os.File
+	if *allBinaries {
+		if output != "" {
+			if fi, err := os.Stat(output); err != nil || !fi.IsDir() {
+				die("-output must be an existing directory with -all-binaries")
+			}
+		}
+	} else if !stampsImageVersion() {
+		ofn = outputFile(base, ext)
+		// The OCI image layout is a directory which is written at the
+		// very end; for everything else open the output file now so
+		// that we fail early
+		if of, err = openOutput(ofn); err != nil {
+			die("error opening output file: %v", err)
+		}
 	}
+	endPhase()
 
-	cmd := exec.Cmd{
-		Env: []string{
-			"GOPATH=" + tmpdir,
-			"GOBIN=" + gobin,
-			"GOROOT=" + goroot,
-			"CGO_ENABLED=0",
-			"PATH=" + os.Getenv("PATH"),
-		},
-		Path:   gocmd,
-		Args:   args,
-		Stderr: os.Stderr,
-		Stdout: os.Stdout,
+	endPhase = phase("prepare")
+	// With a cache directory, binaries built before from the same
+	// revision, with the same flags and tools, are used as they are. The
+	// key is only known once there is a checkout.
+	var key string
+	cached := false
+	goArgs := append([]string(nil), args...)
+	// Some steps need the source before the build, so fetch it first when
+	// building from the GOPATH. A cached GOPATH holds what earlier builds
+	// fetched, which is brought up to date every time.
+	if src == "" && (*cacheDir != "" || *stampVersion != "" || *goGenerate || *revision != "" || *expectCommit != "" || len(patches) > 0) {
+		debug("fetching...")
+		get := []string{gocmd, "get", "-d", target}
+		if *cacheDir != "" {
+			if err := resetCheckout(projpath); err != nil {
+				die("error resetting the cached source: %v", err)
+			}
+			get = []string{gocmd, "get", "-d", "-u", target}
+		}
+		if err := runGo(env, "", get); err != nil {
+			die("error running go: %v", err)
+		}
+	}
+	if *revision != "" {
+		if err := gitCheckout(projpath, *revision); err != nil {
+			die("error checking out %s: %v", *revision, err)
+		}
+	}
+	if *expectCommit != "" {
+		if err := checkCommit(projpath, *expectCommit); err != nil {
+			die(err.Error())
+		}
+	}
+	// The version stamped into the binaries is part of the cache key
+	ldflags := *goLdflags
+	if *stampVersion != "" {
+		version, err := gitDescribe(projpath)
+		if err != nil {
+			die("can't determine the version to stamp: %v", err)
+		}
+		debug("stamping version: ", version)
+		ldflags += fmt.Sprintf(" -X %s=%s", *stampVersion, version)
+		if !flagSet("image-version") {
+			if err := checkImageVersion(version); err != nil {
+				die("can't use the stamped version as image version: %v", err)
+			}
+			*imageVersion = version
+		}
+	}
+	if *cacheDir != "" && *revision == "" {
+		outputs, err := outputPaths(base, ext)
+		if err != nil {
+			die("error checking the cache: %v", err)
+		}
+		if key, err = buildKey(gocmd, projpath, target, goArgs, env, ldflags, outputs); err != nil {
+			die("error checking the cache: %v", err)
+		}
+		if key != "" {
+			if cached, err = restoreBinaries(key, gobin); err != nil {
+				die("error reading cached binaries: %v", err)
+			}
+		}
+		if cached {
+			debug("using the binaries cached as ", key)
+		}
+	}
+	for _, p := range patches {
+		if err := applyPatch(projpath, p); err != nil {
+			die("error applying %s: %v", p, err)
+		}
+	}
+	// Patching and generating code usually leave the checkout dirty, so
+	// this comes after describing it
+	if *goGenerate && !cached {
+		if err := runGo(env, projpath, []string{gocmd, "generate", "./..."}); err != nil {
+			die("error running go generate: %v", err)
+		}
+	}
+	if *reproducible {
+		// Keep the paths of the build and the random build ID out of
+		// the binary
+		trim, err := trimpathFlags(gocmd, gopath)
+		if err != nil {
+			die("error checking the go version: %v", err)
+		}
+		args = append(args, trim...)
+		ldflags += " -buildid="
 	}
-	debug("env:", cmd.Env)
-	debug("running command:", strings.Join(cmd.Args, " "))
-	if err := cmd.Run(); err != nil {
-		die("error running go: %v", err)
+	// How many packages are built at once doesn't change the binaries, so
+	// it is left out of the cache key
+	var parallel []string
+	if *jobs > 0 {
+		parallel = []string{"-p", strconv.Itoa(*jobs)}
 	}
+	args = append(args, parallel...)
+	args = append(args, "-ldflags", ldflags, target)
+	if !cached {
+		debug("building...")
+		if err := runGo(env, src, args); err != nil {
+			die("error running go: %v", err)
+		}
+		if *runTests {
+			debug("testing...")
+			test := append([]string{gocmd, "test", "-tags", tags}, parallel...)
+			test = append(test, target)
+			if err := runGo(env, src, test); err != nil {
+				die("tests failed: %v", err)
+			}
+		}
+	}
+	if key != "" && !cached {
+		if err := storeBinaries(key, gobin); err != nil {
+			die("error caching binaries: %v", err)
+		}
+		debug("cached the binaries as ", key)
+	}
+	endPhase()
 
-	// Check that we got 1 binary from the go get command
+	// Check that we got 1 binary from the go get command, unless we
+	// are to package all of them
 	fi, err := ioutil.ReadDir(gobin)
 	if err != nil {
 		die(err.Error())
@@ -128,33 +710,262 @@ func main() {
 	switch {
 	case len(fi) < 1:
 		die("no binaries found in gobin")
-	case len(fi) > 1:
+	case len(fi) > 1 && !*allBinaries:
 		debug(fmt.Sprint(fi))
-		die("can't handle multiple binaries")
+		die("can't handle multiple binaries; use -all-binaries to build an image for each")
 	}
-	fn := fi[0].Name()
-	debug("found binary: ", fn)
+	if !*cgo {
+		// Nothing but the binary is added to the image, so it would not
+		// run if cgo slipped back into the build
+		for _, f := range fi {
+			why, err := dynamicLinking(filepath.Join(gobin, f.Name()))
+			if err != nil {
+				die("error reading binary: %v", err)
+			}
+			switch {
+			case why == "":
+			case *allowDynamic:
+				warn("%s is dynamically linked: %s", f.Name(), why)
+			default:
+				die("%s is dynamically linked: %s; build it with -cgo, or give -allow-dynamic", f.Name(), why)
+			}
+		}
+	}
+	if !*allBinaries {
+		// Names including the stamped version are only known now
+		if stampsImageVersion() {
+			ofn = outputFile(base, ext)
+			if of, err = openOutput(ofn); err != nil {
+				die("error opening output file: %v", err)
+			}
+		}
+		packImage(fi[0].Name(), *name, ofn, of, *outputDir, gopath, gobin, projpath, tmpdir, topts)
+		return
+	}
+	for _, f := range fi {
+		fn := f.Name()
+		debug("found binary: ", fn)
+		name, err := types.NewACName(path.Join(strings.TrimSuffix(ns, "/..."), fn))
+		if err != nil {
+			die("bad app name: %v", err)
+		}
+		// Suffix the images with the binary they are for, e.g.
+		// example.com/tools/... --> tools-fmt.aci, tools-lint.aci
+		ibase := base
+		if fn != base {
+			ibase += "-" + fn
+		}
+		ofn := outputFile(ibase, ext)
+		of, err := openOutput(ofn)
+		if err != nil {
+			die("error opening output file: %v", err)
+		}
+		odir := *outputDir
+		if odir != "" {
+			odir = filepath.Join(odir, fn)
+		}
+		packImage(fn, *name, ofn, of, odir, gopath, gobin, projpath, filepath.Join(tmpdir, "images", fn), topts)
+	}
+}
+
+// stampVarRE matches the <package path>.<name> of a string variable
+var stampVarRE = regexp.MustCompile(`^[A-Za-z0-9._~+/-]+\.[A-Za-z_][A-Za-z0-9_]*$`)
 
-	// Set up rootfs for ACI layout
-	rfs := filepath.Join(acidir, "rootfs")
-	err = os.MkdirAll(rfs, 0755)
+// commitRE matches the hash of a commit, or a prefix of it long enough to
+// tell it apart
+var commitRE = regexp.MustCompile(`^[0-9a-fA-F]{12,64}$`)
+
+// checkImageVersion checks that the version v can be part of the name of the
+// output file, without taking it anywhere else
+func checkImageVersion(v string) error {
+	if v == "" || strings.ContainsAny(v, `/\`) || strings.Contains(v, "..") {
+		return fmt.Errorf("%q is empty, or contains a path separator or ..", v)
+	}
+	return nil
+}
+
+// stampsImageVersion reports whether the image file name includes the version
+// stamped into the binary, which is only known once the source is there
+func stampsImageVersion() bool {
+	return *stampVersion != "" && *discoveryNaming && !flagSet("image-version")
+}
+
+// trimpathFlags returns the flags which remove the paths of the build from
+// the binaries built by gocmd in gopath: -trimpath since go 1.13, and the
+// compiler and assembler flags it replaced before
+func trimpathFlags(gocmd, gopath string) ([]string, error) {
+	out, err := goCommand(nil, "", []string{gocmd, "version"}).Output()
 	if err != nil {
-		die(err.Error())
+		return nil, err
+	}
+	// e.g. go version go1.12.5 linux/amd64
+	fields := strings.Fields(string(out))
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("unexpected output %q", out)
+	}
+	v := strings.SplitN(strings.TrimPrefix(fields[2], "go1."), ".", 2)
+	if minor, err := strconv.Atoi(v[0]); err == nil && minor < 13 {
+		trim := "-trimpath=" + filepath.Join(gopath, "src")
+		return []string{"-gcflags", trim, "-asmflags", trim}, nil
+	}
+	// Newer and development versions
+	return []string{"-trimpath"}, nil
+}
+
+// goTarget returns the GOOS and GOARCH go builds for with the environment
+// env, on the host or in a container (see goCommand)
+func goTarget(gocmd string, env []string) (string, string, error) {
+	out, err := goCommand(env, "", []string{gocmd, "env", "GOOS", "GOARCH"}).Output()
+	if err != nil {
+		return "", "", err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("unexpected output %q", out)
+	}
+	return fields[0], fields[1], nil
+}
+
+// flagSet reports whether the named flag was given on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// runGo runs go, as given by args, in the directory dir with the environment
+// env, on the host or in a container (see goCommand)
+func runGo(env []string, dir string, args []string) error {
+	cmd := goCommand(env, dir, args)
+	cmd.Stderr = commandStderr()
+	cmd.Stdout = commandStdout()
+	logCommand(cmd.Args)
+	p := startProgress("running go " + args[1])
+	defer p.done()
+	return cmd.Run()
+}
+
+// outputFile returns the name of the image file to write for an image named
+// base (the last component of its name), with the extension ext
+func outputFile(base, ext string) string {
+	ofn := base + ext
+	if *discoveryNaming {
+		ofn = fmt.Sprintf("%s-%s-%s-%s%s", base, *imageVersion, goos, goarch, ext)
+	}
+	if output != "" {
+		if fi, err := os.Stat(output); err == nil && fi.IsDir() {
+			ofn = filepath.Join(output, ofn)
+		} else {
+			ofn = output
+		}
+	}
+	return ofn
+}
+
+// openOutput opens the image file ofn for writing, unless the image is a
+// directory, in which case it returns nil
+func openOutput(ofn string) (*os.File, error) {
+	if *format == "oci" || *outputDir != "" {
+		return nil, nil
 	}
+	return os.OpenFile(ofn, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+}
 
-	// Move the binary into the rootfs
-	ep := filepath.Join(rfs, fn)
-	err = os.Rename(filepath.Join(gobin, fn), ep)
+// packImage builds the image named name for the binary fn in gobin, built in
+// the GOPATH gopath from projpath, and writes it to ofn (opened as of), or
+// lays it out in the directory odir if that is set. Temporary files go in
+// workdir.
+func packImage(fn string, name types.ACName, ofn string, of *os.File, odir, gopath, gobin, projpath, workdir string, topts tarOptions) {
+	debug("found binary: ", fn)
+
+	endPhase := phase("assets")
+	// Lay out the rootfs; files are read from where they are when the
+	// image is written
+	fs := newRootfs()
+	fs.skipSpecial = *skipSpecial
+	fs.linkFiles = *linkAssets
+	fs.add(fn, filepath.Join(gobin, fn))
+	debug("added binary to rootfs:", fn)
+	placeholders, err := placeholderMapping(gopath, projpath, defines)
 	if err != nil {
 		die(err.Error())
 	}
-	debug("moved binary to:", ep)
+	for _, e := range assetExcludes {
+		abs, err := filepath.Abs(replacePlaceholders(e, placeholders))
+		if err != nil {
+			die("bad asset exclude %q: %v", e, err)
+		}
+		fs.excludes = append(fs.excludes, abs)
+	}
+	var assetFiles []string
+	for _, a := range assets {
+		files, err := addAsset(fs, replacePlaceholders(a, placeholders))
+		if err != nil {
+			die("error adding asset: %v", err)
+		}
+		assetFiles = append(assetFiles, files...)
+		debug("added asset to rootfs:", a)
+	}
+	if len(assetHooks) > 0 {
+		if err := runAssetHooks(fs, filepath.Join(workdir, "hooked"), assetFiles, assetHooks); err != nil {
+			die("error running asset hooks: %v", err)
+		}
+	}
+	if *includeTzdata {
+		if err := addTzdata(fs); err != nil {
+			die("error adding timezone database: %v", err)
+		}
+	}
+	for _, d := range makeDirs {
+		var mode os.FileMode
+		parts := strings.SplitN(d, ":", 2)
+		if len(parts) == 2 {
+			if mode, err = parseMode(parts[1]); err != nil {
+				die("bad -make-dir %q: %v", d, err)
+			}
+		}
+		if err := fs.mkdir(parts[0], mode); err != nil {
+			die("can't create directory: %v", err)
+		}
+	}
+	if err := addInterpreters(fs); err != nil {
+		die("error adding script interpreters: %v", err)
+	}
+	var libDirs []string
+	for _, l := range libPath {
+		libDirs = append(libDirs, filepath.SplitList(l)...)
+	}
+	libs, err := newLibResolver(libDirs)
+	if err != nil {
+		die("error reading library search paths: %v", err)
+	}
+	if err := addLibraryDeps(fs, libs); err != nil {
+		die("error adding shared libraries: %v", err)
+	}
+	if len(libs.missing) > 0 {
+		if !*ignoreMissing {
+			die("could not find libraries:\n\t%s", strings.Join(libs.missing, "\n\t"))
+		}
+		warn("could not find libraries, leaving them out of the image:\n\t%s", strings.Join(libs.missing, "\n\t"))
+	}
 
 	// Build the ACI
+	endManifest := phase("manifest")
 	im := schema.ImageManifest{
 		ACKind:    types.ACKind("ImageManifest"),
 		ACVersion: schema.AppContainerVersion,
-		Name:      *name,
+		Name:      name,
+		// Always set the labels used by appc discovery, so the image can be
+		// served as-is from a discovery endpoint
+		Labels: types.Labels{
+			{Name: "version", Value: *imageVersion},
+			{Name: "os", Value: goos},
+			{Name: "arch", Value: goarch},
+		},
 		App: &types.App{
 			Exec: types.Exec{
 				filepath.Join("/", fn),
@@ -163,27 +974,390 @@ func main() {
 			Group: "0",
 		},
 	}
+	// Record the revision the binary was built from, which doesn't tell
+	// the whole story if there were uncommitted changes
+	vcs, err := readVCSInfo(projpath)
+	if err != nil {
+		die("error reading the revision of the project: %v", err)
+	}
+	if vcs != nil {
+		rev := vcs.rev
+		if vcs.dirty {
+			if *forbidDirty {
+				die("%s has uncommitted changes", projpath)
+			}
+			warn("%s has uncommitted changes, the image can't be rebuilt from revision %s", projpath, rev)
+			rev += "-dirty"
+		}
+		im.Labels = append(im.Labels, types.Label{Name: types.ACName(vcs.vcs), Value: rev})
+		im.Annotations = append(im.Annotations, vcs.annotations()...)
+	}
+	if *ciAnnots {
+		as := ciAnnotations()
+		if as == nil {
+			warn("not running in a known CI system, so there is nothing to record with -ci-annotations")
+		}
+		im.Annotations = append(im.Annotations, as...)
+	}
 	debug(im)
+	endManifest()
 
-	gw := gzip.NewWriter(of)
-	tr := tar.NewWriter(gw)
+	if *stubEtc {
+		if err := addStubEtc(fs, filepath.Join(workdir, "etc"), im.App.User, im.App.Group); err != nil {
+			die("error generating /etc files: %v", err)
+		}
+	}
+	for _, c := range chmods {
+		i := strings.LastIndex(c, "=")
+		if i <= 0 {
+			die("bad -chmod %q: must be of the form <path in image>=<mode>", c)
+		}
+		mode, err := parseMode(c[i+1:])
+		if err != nil {
+			die("bad -chmod %q: %v", c, err)
+		}
+		if err := fs.chmod(c[:i], mode); err != nil {
+			die("can't change permissions: %v", err)
+		}
+	}
+	if err := fs.checkSymlinks(*rewriteSymlinks); err != nil {
+		die(err.Error())
+	}
+	// Libraries are looked up on the build host, but the image has to
+	// hold them where the loader looks for them, too
+	missing, err := missingLibraries(fs)
+	if err != nil {
+		die("error checking shared libraries: %v", err)
+	}
+	if len(missing) > 0 && *ignoreMissing {
+		// Those not found on the build host were warned about already
+		left := map[string]bool{}
+		for _, m := range libs.missing {
+			left[m] = true
+		}
+		var more []string
+		for _, m := range missing {
+			if !left[m] {
+				more = append(more, m)
+			}
+		}
+		if len(more) > 0 {
+			warn("libraries missing from the image:\n\t%s", strings.Join(more, "\n\t"))
+		}
+	} else if len(missing) > 0 {
+		die("libraries missing from the image:\n\t%s", strings.Join(missing, "\n\t"))
+	}
+	// Easily done when mixing cross-compiled binaries with the libraries
+	// of the build host
+	foreign, err := foreignFiles(fs, goos, goarch)
+	if err != nil {
+		die("error checking the architecture of files: %v", err)
+	}
+	if len(foreign) > 0 {
+		if *strictArch {
+			die("files not built for %s/%s:\n\t%s", goos, goarch, strings.Join(foreign, "\n\t"))
+		}
+		warn("files not built for %s/%s:\n\t%s", goos, goarch, strings.Join(foreign, "\n\t"))
+	}
+	endPhase()
 
-	defer func() {
-		tr.Close()
-		gw.Close()
-		of.Close()
-	}()
+	if *verify {
+		endPhase = phase("verify")
+		dir := filepath.Join(workdir, "verify")
+		if err := fs.writeDir(dir, *preserveAttrs, false); err != nil {
+			die("error laying out the rootfs to verify: %v", err)
+		}
+		if err := verifyRootfs(dir, im.App.Exec); err != nil {
+			die("the image can't run its program: %v", err)
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			die(err.Error())
+		}
+		endPhase()
+	}
 
-	iw := aci.NewImageWriter(im, tr)
-	err = filepath.Walk(acidir, aci.BuildWalker(acidir, iw))
+	endPhase = phase("write")
+	size, err := fs.size()
 	if err != nil {
 		die(err.Error())
 	}
-	err = iw.Close()
+	fs.progress = newProgress("writing "+fn, size)
+	if odir != "" {
+		if err := writeACIDir(odir, fs, im, *preserveAttrs, *updateOutput); err != nil {
+			die("error writing image directory: %v", err)
+		}
+		fs.progress.done()
+		endPhase()
+		info("Wrote %s", odir)
+		return
+	}
+
+	// The image refers to its dependencies by their hash, so they are
+	// written first
+	var depsFile string
+	var depsHash hash.Hash
+	if *splitDeps {
+		deps := fs.splitDeps()
+		if len(deps.entries) == 0 {
+			warn("%s needs no shared libraries or interpreters, so there is nothing to split off with -split-deps", fn)
+		} else {
+			depsName, err := depsImageName(deps)
+			if err != nil {
+				die("error reading dependencies: %v", err)
+			}
+			depsFile = depsOutputFile(ofn, string(depsName))
+			var dep types.Dependency
+			if dep, depsHash, err = writeDepsImage(depsFile, depsName, deps); err != nil {
+				die("error writing dependency image: %v", err)
+			}
+			im.Dependencies = append(im.Dependencies, dep)
+			info("Wrote %s", depsFile)
+		}
+	}
+
+	// Hash of the uncompressed ACI, from which rkt derives the image key
+	tarHash := sha512.New()
+	switch *format {
+	case "aci":
+		cw, err := newCompressor(of, *compression, *compressionLvl)
+		if err != nil {
+			die("error setting up compression: %v", err)
+		}
+		if err := writeACI(io.MultiWriter(cw, tarHash), fs, im, topts); err != nil {
+			die(err.Error())
+		}
+		if err := cw.Close(); err != nil {
+			die("error compressing image: %v", err)
+		}
+	case "oci":
+		if err := writeOCILayout(ofn, fs, im, *compression, *compressionLvl, topts); err != nil {
+			die("error writing OCI image layout: %v", err)
+		}
+	case "oci-archive":
+		if err := writeOCIArchive(of, filepath.Join(workdir, "oci"), fs, im, *compression, *compressionLvl, topts); err != nil {
+			die("error writing OCI image layout: %v", err)
+		}
+	case "docker":
+		if err := writeDockerArchive(of, filepath.Join(workdir, "docker"), fs, im, topts); err != nil {
+			die("error writing docker image: %v", err)
+		}
+	}
+	if of != nil {
+		if err := of.Close(); err != nil {
+			die("error writing output file: %v", err)
+		}
+	}
+	fs.progress.done()
+	if *format == "aci" && !*noValidate {
+		if err := validateImage(ofn); err != nil {
+			die("%s is not a valid ACI: %v", ofn, err)
+		}
+	}
+	endPhase()
+	info("Wrote %s", ofn)
+
+	// Dependencies are imported and pushed first, so that they can be
+	// found when the image is
+	if depsFile != "" {
+		publishImage(depsFile, depsHash)
+	}
+	publishImage(ofn, tarHash)
+}
+
+// publishImage checksums, signs, imports and pushes the image file ofn, as
+// asked for by the flags. tarHash is the hash of the uncompressed image.
+func publishImage(ofn string, tarHash hash.Hash) {
+	// Files written next to the image, which are uploaded with it
+	var derived []string
+	if *checksum {
+		sum, err := writeChecksum(ofn)
+		if err != nil {
+			die("error writing checksum: %v", err)
+		}
+		info("Wrote %s", sum)
+		derived = append(derived, sum)
+		if *format == "aci" {
+			info("Image key: %s", imageKey(tarHash))
+		}
+	}
+	if *signKey != "" {
+		endPhase := phase("sign")
+		sig, err := signImage(ofn, *signKey, *gpgHomedir)
+		if err != nil {
+			die("error signing image: %v", err)
+		}
+		endPhase()
+		info("Wrote %s", sig)
+		derived = append(derived, sig)
+	}
+	if *importIntoRkt {
+		endPhase := phase("import")
+		if err := rktFetch(ofn); err != nil {
+			die("error importing image into rkt: %v", err)
+		}
+		endPhase()
+	}
+	if *push != "" {
+		endPhase := phase("push")
+		if err := pushImage(*push, ofn, derived); err != nil {
+			die(err.Error())
+		}
+		endPhase()
+	}
+}
+
+// depsTarOptions are those the dependency images are written with, whatever
+// the options of the images depending on them, so that the same
+// dependencies always make the same image
+var depsTarOptions = tarOptions{mtime: time.Unix(0, 0)}
+
+// depsImageName returns the name of the ACI holding the dependencies split
+// off an image as fs, which is derived from their contents: images with the
+// same dependencies share the ACI.
+func depsImageName(fs *rootfs) (types.ACName, error) {
+	h := sha256.New()
+	tw := tar.NewWriter(h)
+	if err := fs.writeTar(tw, aci.RootfsDir, depsTarOptions); err != nil {
+		return "", err
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	name, err := types.NewACName(fmt.Sprintf("goaci-deps-%x", h.Sum(nil)[:16]))
 	if err != nil {
-		die(err.Error())
+		return "", err
+	}
+	return *name, nil
+}
+
+// depsOutputFile returns the name of the file the dependency image named
+// name goes in: next to the image written to ofn, following the discovery
+// template if that does, with latest as the version, as dependency images
+// have none
+func depsOutputFile(ofn, name string) string {
+	fn := name + formatExts["aci"]
+	if *discoveryNaming {
+		fn = fmt.Sprintf("%s-latest-%s-%s%s", name, goos, goarch, formatExts["aci"])
+	}
+	return filepath.Join(filepath.Dir(ofn), fn)
+}
+
+// writeDepsImage writes the ACI named name, holding the dependencies split
+// off an image as fs, to ofn. The ACI has no app and is only labelled with
+// the os and arch. It returns the dependency of the image on the ACI and the
+// hash of the uncompressed ACI.
+func writeDepsImage(ofn string, name types.ACName, fs *rootfs) (types.Dependency, hash.Hash, error) {
+	var dep types.Dependency
+	labels := types.Labels{
+		{Name: "os", Value: goos},
+		{Name: "arch", Value: goarch},
+	}
+	dm := schema.ImageManifest{
+		ACKind:    types.ACKind("ImageManifest"),
+		ACVersion: schema.AppContainerVersion,
+		Name:      name,
+		Labels:    labels,
+	}
+	size, err := fs.size()
+	if err != nil {
+		return dep, nil, err
+	}
+	of, err := openOutput(ofn)
+	if err != nil {
+		return dep, nil, err
+	}
+	defer of.Close()
+	fs.progress = newProgress("writing "+ofn, size)
+	tarHash := sha512.New()
+	cw, err := newCompressor(of, *compression, *compressionLvl)
+	if err != nil {
+		return dep, nil, err
+	}
+	if err := writeACI(io.MultiWriter(cw, tarHash), fs, dm, depsTarOptions); err != nil {
+		return dep, nil, err
+	}
+	if err := cw.Close(); err != nil {
+		return dep, nil, err
+	}
+	if err := of.Close(); err != nil {
+		return dep, nil, err
+	}
+	fs.progress.done()
+	if !*noValidate {
+		if err := validateImage(ofn); err != nil {
+			return dep, nil, fmt.Errorf("%s is not a valid ACI: %v", ofn, err)
+		}
+	}
+	id, err := types.NewHash(fmt.Sprintf("sha512-%x", tarHash.Sum(nil)))
+	if err != nil {
+		return dep, nil, err
+	}
+	return types.Dependency{App: name, ImageID: id, Labels: labels}, tarHash, nil
+}
+
+// writeACI writes an ACI with the given root filesystem and manifest as a
+// tarball to w. The manifest is written first so that it can be read without
+// going through the whole rootfs.
+func writeACI(w io.Writer, fs *rootfs, im schema.ImageManifest, topts tarOptions) error {
+	b, err := json.Marshal(im)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	hdr := &tar.Header{
+		Name:     aci.ManifestFile,
+		Mode:     0644,
+		Size:     int64(len(b)),
+		ModTime:  topts.mtime,
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return err
+	}
+	if err := fs.writeTar(tw, aci.RootfsDir, topts); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeACIDir lays out an ACI with the given root filesystem and manifest in
+// the directory dir, which must not exist or be empty unless the image in it
+// is to be updated, and validates the result. See rootfs.writeDir for
+// preserveAttrs and update.
+func writeACIDir(dir string, fs *rootfs, im schema.ImageManifest, preserveAttrs, update bool) error {
+	if fi, err := ioutil.ReadDir(dir); err == nil && len(fi) > 0 && !update {
+		return fmt.Errorf("%s is not empty", dir)
+	}
+	if err := fs.writeDir(filepath.Join(dir, aci.RootfsDir), preserveAttrs, update); err != nil {
+		return err
+	}
+	b, err := json.Marshal(im)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, aci.ManifestFile), b, 0644); err != nil {
+		return err
+	}
+	return aci.ValidateLayout(dir)
+}
+
+// buildTime returns the modification time to record in the image, which is
+// fixed so that building the same sources twice yields identical images
+func buildTime() (time.Time, error) {
+	epoch := *sourceDateEpoch
+	if epoch < 0 {
+		epoch = 0
+		if env := os.Getenv("SOURCE_DATE_EPOCH"); env != "" {
+			var err error
+			if epoch, err = strconv.ParseInt(env, 10, 64); err != nil {
+				return time.Time{}, err
+			}
+		}
 	}
-	fmt.Println("Wrote", of.Name())
+	return time.Unix(epoch, 0), nil
 }
 
 // strip replaces all characters that are not [a-Z_] with _
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDeterministic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goaci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rfs := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	app := filepath.Join(rfs, "app")
+	if err := ioutil.WriteFile(app, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fs := newRootfs()
+	if _, err := fs.addTree("", rfs); err != nil {
+		t.Fatal(err)
+	}
+	topts := tarOptions{mtime: time.Unix(1500000000, 0)}
+	writers := map[string]func(w io.Writer, scratch string) error{
+		"aci": func(w io.Writer, scratch string) error {
+			cw, err := newCompressor(w, "gzip", 0)
+			if err != nil {
+				return err
+			}
+			if err := writeACI(cw, fs, testManifest(t), topts); err != nil {
+				return err
+			}
+			return cw.Close()
+		},
+		"oci-archive": func(w io.Writer, scratch string) error {
+			return writeOCIArchive(w, scratch, fs, testManifest(t), "gzip", 0, topts)
+		},
+		"docker": func(w io.Writer, scratch string) error {
+			return writeDockerArchive(w, scratch, fs, testManifest(t), topts)
+		},
+	}
+	for format, write := range writers {
+		var images [2]bytes.Buffer
+		for i := range images {
+			// The times of the files on disk are left out
+			now := time.Now().Add(time.Duration(i) * time.Hour)
+			if err := os.Chtimes(app, now, now); err != nil {
+				t.Fatal(err)
+			}
+			scratch := filepath.Join(dir, format, strconv.Itoa(i))
+			if err := write(&images[i], scratch); err != nil {
+				t.Fatalf("%s: %v", format, err)
+			}
+		}
+		if !bytes.Equal(images[0].Bytes(), images[1].Bytes()) {
+			t.Errorf("%s: building twice gives different images", format)
+		}
+	}
+}
+
+func TestBuildTime(t *testing.T) {
+	defer os.Setenv("SOURCE_DATE_EPOCH", os.Getenv("SOURCE_DATE_EPOCH"))
+	defer func(epoch int64) { *sourceDateEpoch = epoch }(*sourceDateEpoch)
+	tests := []struct {
+		flag int64
+		env  string
+		want int64
+		ok   bool
+	}{
+		{-1, "", 0, true},
+		{-1, "1500000000", 1500000000, true},
+		{42, "1500000000", 42, true},
+		{0, "1500000000", 0, true},
+		{-1, "yesterday", 0, false},
+	}
+	for _, tt := range tests {
+		*sourceDateEpoch = tt.flag
+		os.Setenv("SOURCE_DATE_EPOCH", tt.env)
+		got, err := buildTime()
+		if (err == nil) != tt.ok || (tt.ok && got.Unix() != tt.want) {
+			t.Errorf("buildTime() with -source-date-epoch %d and $SOURCE_DATE_EPOCH %q = %v, %v, want %d", tt.flag, tt.env, got.Unix(), err, tt.want)
+		}
+	}
+}
+
+func TestCheckImageVersion(t *testing.T) {
+	tests := []struct {
+		v  string
+		ok bool
+	}{
+		{"latest", true},
+		{"v1.2.0", true},
+		{"v1.2.0-3-g0123abc-dirty", true},
+		{"", false},
+		{"..", false},
+		{"../../etc", false},
+		{"v1..2", false},
+		{"a/b", false},
+		{`a\b`, false},
+	}
+	for _, tt := range tests {
+		if err := checkImageVersion(tt.v); (err == nil) != tt.ok {
+			t.Errorf("checkImageVersion(%q) = %v, want ok %v", tt.v, err, tt.ok)
+		}
+	}
+}
+
+func TestStampVarRE(t *testing.T) {
+	tests := []struct {
+		v  string
+		ok bool
+	}{
+		{"main.version", true},
+		{"example.com/myapp/internal/build.Version", true},
+		{"main._v2", true},
+		{"version", false},
+		{"main.", false},
+		{"main.2v", false},
+		{"main.version=1", false},
+		{"main.v -extldflags=-static", false},
+		{"main.v' -X 'main.w", false},
+	}
+	for _, tt := range tests {
+		if got := stampVarRE.MatchString(tt.v); got != tt.ok {
+			t.Errorf("stampVarRE.MatchString(%q) = %v, want %v", tt.v, got, tt.ok)
+		}
+	}
+}
+
+func TestCommitRE(t *testing.T) {
+	tests := []struct {
+		v  string
+		ok bool
+	}{
+		{"9481945228b97c5d019596b921d8b03833964d9e", true},
+		{"9481945228B9", true},
+		{"9481945228b", false},
+		{"", false},
+		{"v2.0.9", false},
+		{"9481945228b97c5d019596b921d8b03833964d9eg", false},
+	}
+	for _, tt := range tests {
+		if got := commitRE.MatchString(tt.v); got != tt.ok {
+			t.Errorf("commitRE.MatchString(%q) = %v, want %v", tt.v, got, tt.ok)
+		}
+	}
+}
+
+func TestGoTarget(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not installed")
+	}
+	gotOS, gotArch, err := goTarget("go", append(os.Environ(), "GOOS=freebsd", "GOARCH=arm64"))
+	if err != nil || gotOS != "freebsd" || gotArch != "arm64" {
+		t.Errorf("goTarget with GOOS=freebsd GOARCH=arm64 = %s, %s, %v", gotOS, gotArch, err)
+	}
+}
+
+func TestDepsImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goaci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for f, contents := range map[string]string{"app1": "1", "app2": "2", "libc.so.6": "libc", "libm.so.6": "libm"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(contents), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Writes the dependency image of an image with the app and libraries
+	write := func(app string, libs ...string) (string, string) {
+		fs := newRootfs()
+		fs.add(app, filepath.Join(dir, app))
+		for _, l := range libs {
+			fs.addDep("lib/"+l, filepath.Join(dir, l))
+		}
+		deps := fs.splitDeps()
+		name, err := depsImageName(deps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dep, _, err := writeDepsImage(filepath.Join(dir, app+"-deps.aci"), name, deps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dep.App != name {
+			t.Errorf("dependency on %s, want %s", dep.App, name)
+		}
+		return string(name), dep.ImageID.String()
+	}
+	name1, id1 := write("app1", "libc.so.6")
+	name2, id2 := write("app2", "libc.so.6")
+	if name1 != name2 || id1 != id2 {
+		t.Errorf("images needing the same libraries depend on %s (%s) and %s (%s)", name1, id1, name2, id2)
+	}
+	if name3, _ := write("app2", "libc.so.6", "libm.so.6"); name3 == name1 {
+		t.Errorf("images needing other libraries both depend on %s", name1)
+	}
+}
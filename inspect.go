@@ -0,0 +1,106 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/appc/spec/aci"
+)
+
+func init() {
+	commands["inspect"] = runInspect
+}
+
+// runInspect prints the manifest of an ACI, its files with their sizes, its
+// uncompressed size and its image key
+func runInspect(args []string) {
+	if len(args) != 1 {
+		die("usage: goaci inspect IMAGE")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		die(err.Error())
+	}
+	defer f.Close()
+	r, err := newDecompressor(f)
+	if err != nil {
+		die("error reading %s: %v", args[0], err)
+	}
+	defer r.Close()
+
+	// The image key is the hash of the whole uncompressed archive
+	h := sha512.New()
+	cw := &countingWriter{w: h}
+	tr := tar.NewReader(io.TeeReader(r, cw))
+	var manifest []byte
+	var files []*tar.Header
+	var size int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			die("error reading %s: %v", args[0], err)
+		}
+		if hdr.Name == aci.ManifestFile {
+			if manifest, err = ioutil.ReadAll(tr); err != nil {
+				die("error reading %s: %v", args[0], err)
+			}
+			continue
+		}
+		files = append(files, hdr)
+		size += hdr.Size
+	}
+	// Hash what follows the end of the archive, too
+	if _, err := io.Copy(cw, r); err != nil {
+		die("error reading %s: %v", args[0], err)
+	}
+
+	if manifest == nil {
+		die("%s has no manifest", args[0])
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, manifest, "", "\t"); err != nil {
+		die("bad manifest: %v", err)
+	}
+	fmt.Println("Manifest:")
+	fmt.Println(out.String())
+	fmt.Println("Files:")
+	for _, hdr := range files {
+		name := hdr.Name
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			name += " -> " + hdr.Linkname
+		case tar.TypeLink:
+			name += " link to " + hdr.Linkname
+		}
+		fmt.Printf("%v %4d/%-4d %10d %s\n", os.FileMode(hdr.Mode)|typeMode(hdr.Typeflag), hdr.Uid, hdr.Gid, hdr.Size, name)
+	}
+	fmt.Printf("Total size of files: %s (%d bytes)\n", formatBytes(size), size)
+	fmt.Printf("Uncompressed size: %s (%d bytes)\n", formatBytes(cw.n), cw.n)
+	fmt.Println("Image key:", imageKey(h))
+}
+
+// typeMode returns the type bits of a file mode for a tar entry type
+func typeMode(typeflag byte) os.FileMode {
+	switch typeflag {
+	case tar.TypeDir:
+		return os.ModeDir
+	case tar.TypeSymlink:
+		return os.ModeSymlink
+	case tar.TypeChar:
+		return os.ModeDevice | os.ModeCharDevice
+	case tar.TypeBlock:
+		return os.ModeDevice
+	case tar.TypeFifo:
+		return os.ModeNamedPipe
+	}
+	return 0
+}
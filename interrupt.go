@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ctx is cancelled when goaci is interrupted, which kills the commands it
+// runs, like go and git, and stops copying and writing files, so that it
+// can clean up and exit
+var ctx, cancel = context.WithCancel(context.Background())
+
+// cleanups are run, last first, before goaci exits, even when it dies
+var cleanups []func()
+
+// atExit makes f run before goaci exits
+func atExit(f func()) {
+	cleanups = append(cleanups, f)
+}
+
+func runCleanups() {
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+	cleanups = nil
+}
+
+// handleInterrupts cancels ctx on SIGINT or SIGTERM. A second one makes
+// goaci exit at once, without cleaning up.
+func handleInterrupts() {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+		<-sigs
+		os.Exit(130)
+	}()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+)
+
+const (
+	ldCacheOldMagic = "ld.so-1.7.0"
+	ldCacheNewMagic = "glibc-ld.so.cache1.1"
+
+	// sizes of the headers and entries of both cache formats
+	ldCacheOldHeaderLen = 16
+	ldCacheOldEntryLen  = 12
+	ldCacheNewHeaderLen = 48
+	ldCacheNewEntryLen  = 24
+)
+
+// readLdSoCache returns the libraries listed in an ld.so.cache file, mapping
+// their names to the paths they were found at, in the order of the cache.
+// Only the "new" format written by glibc 2.x is understood; old format
+// entries are skipped.
+func readLdSoCache(path string) (map[string][]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	libs := map[string][]string{}
+
+	// The new format either makes up the whole file, or follows the
+	// entries of the old format, aligned to 8 bytes
+	if bytes.HasPrefix(b, []byte(ldCacheOldMagic)) {
+		if len(b) < ldCacheOldHeaderLen {
+			return libs, nil
+		}
+		n := int(binary.LittleEndian.Uint32(b[12:16]))
+		off := ldCacheOldHeaderLen + n*ldCacheOldEntryLen
+		off = (off + 7) &^ 7
+		if off > len(b) {
+			return libs, nil
+		}
+		b = b[off:]
+	}
+	if !bytes.HasPrefix(b, []byte(ldCacheNewMagic)) || len(b) < ldCacheNewHeaderLen {
+		return libs, nil
+	}
+
+	// String offsets are relative to the start of the new format header
+	str := func(off uint32) (string, bool) {
+		if int(off) >= len(b) {
+			return "", false
+		}
+		s := b[off:]
+		if i := bytes.IndexByte(s, 0); i >= 0 {
+			s = s[:i]
+		}
+		return string(s), true
+	}
+	n := int(binary.LittleEndian.Uint32(b[20:24]))
+	for i := 0; i < n; i++ {
+		e := ldCacheNewHeaderLen + i*ldCacheNewEntryLen
+		if e+ldCacheNewEntryLen > len(b) {
+			break
+		}
+		name, ok1 := str(binary.LittleEndian.Uint32(b[e+4:]))
+		p, ok2 := str(binary.LittleEndian.Uint32(b[e+8:]))
+		if ok1 && ok2 {
+			libs[name] = append(libs[name], p)
+		}
+	}
+	return libs, nil
+}
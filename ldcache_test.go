@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newLdSoCache returns the new format cache listing the given name and path
+// pairs
+func newLdSoCache(entries ...[2]string) []byte {
+	var strs bytes.Buffer
+	strOff := ldCacheNewHeaderLen + len(entries)*ldCacheNewEntryLen
+	b := make([]byte, strOff)
+	copy(b, ldCacheNewMagic)
+	binary.LittleEndian.PutUint32(b[20:], uint32(len(entries)))
+	for i, e := range entries {
+		off := ldCacheNewHeaderLen + i*ldCacheNewEntryLen
+		binary.LittleEndian.PutUint32(b[off+4:], uint32(strOff+strs.Len()))
+		strs.WriteString(e[0] + "\x00")
+		binary.LittleEndian.PutUint32(b[off+8:], uint32(strOff+strs.Len()))
+		strs.WriteString(e[1] + "\x00")
+	}
+	return append(b, strs.Bytes()...)
+}
+
+// oldLdSoCache returns an old format cache of n (empty) entries
+func oldLdSoCache(n int) []byte {
+	b := make([]byte, ldCacheOldHeaderLen+n*ldCacheOldEntryLen)
+	copy(b, ldCacheOldMagic)
+	binary.LittleEndian.PutUint32(b[12:], uint32(n))
+	// The new format follows aligned to 8 bytes
+	for len(b)%8 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func TestReadLdSoCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goaci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	entries := [][2]string{
+		{"libc.so.6", "/lib/x86_64-linux-gnu/libc.so.6"},
+		{"libc.so.6", "/lib32/libc.so.6"},
+		{"libm.so.6", "/lib/x86_64-linux-gnu/libm.so.6"},
+	}
+	libs := map[string][]string{
+		"libc.so.6": {"/lib/x86_64-linux-gnu/libc.so.6", "/lib32/libc.so.6"},
+		"libm.so.6": {"/lib/x86_64-linux-gnu/libm.so.6"},
+	}
+	cache := newLdSoCache(entries...)
+	tests := []struct {
+		name string
+		b    []byte
+		want map[string][]string
+	}{
+		{"new", cache, libs},
+		{"old and new", append(oldLdSoCache(3), cache...), libs},
+		{"old only", oldLdSoCache(3), map[string][]string{}},
+		{"empty", nil, map[string][]string{}},
+		{"garbage", []byte("not a cache at all"), map[string][]string{}},
+		{"short header", cache[:ldCacheNewHeaderLen-1], map[string][]string{}},
+		{"truncated entries", cache[:ldCacheNewHeaderLen+ldCacheNewEntryLen+4], map[string][]string{}},
+		{"truncated strings", cache[:len(cache)-len("/lib/x86_64-linux-gnu/libm.so.6\x00")-1], map[string][]string{
+			"libc.so.6": {"/lib/x86_64-linux-gnu/libc.so.6", "/lib32/libc.so.6"},
+		}},
+	}
+	for _, tt := range tests {
+		p := filepath.Join(dir, "ld.so.cache")
+		if err := ioutil.WriteFile(p, tt.b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readLdSoCache(p)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// isLocalPath reports whether the package argument is a directory on the
+// build host rather than an import path, the same way go does
+func isLocalPath(arg string) bool {
+	return arg == "." || arg == ".." || filepath.IsAbs(arg) ||
+		strings.HasPrefix(arg, "./") || strings.HasPrefix(arg, "../")
+}
+
+// findModule looks for the go.mod file of the module the directory dir is
+// part of, and returns the root directory and the path of that module. ok is
+// false if dir is not part of any module.
+func findModule(dir string) (root, modPath string, ok bool, err error) {
+	for d := dir; ; d = filepath.Dir(d) {
+		f, err := os.Open(filepath.Join(d, "go.mod"))
+		if os.IsNotExist(err) {
+			if filepath.Dir(d) == d {
+				return "", "", false, nil
+			}
+			continue
+		}
+		if err != nil {
+			return "", "", false, err
+		}
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) < 2 || fields[0] != "module" {
+				continue
+			}
+			modPath := fields[1]
+			if uq, err := strconv.Unquote(modPath); err == nil {
+				modPath = uq
+			}
+			return d, modPath, true, nil
+		}
+		if err := s.Err(); err != nil {
+			return "", "", false, err
+		}
+		return "", "", false, fmt.Errorf("%s has no module directive", f.Name())
+	}
+}
+
+// localPackage returns the import path of the package in the directory dir,
+// which must be part of a module, since outside of one a directory says
+// nothing about the import path of the package it holds
+func localPackage(dir string) (string, error) {
+	root, modPath, ok, err := findModule(dir)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("%s is not part of a module; give the import path of the package, with its directory as -local-source", dir)
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(modPath, filepath.ToSlash(rel)), nil
+}
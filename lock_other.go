@@ -0,0 +1,10 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+// lockFile doesn't lock anything on platforms without flock, so builds
+// sharing a cache directory must not run at once there
+func lockFile(path string) (unlock func(), err error) {
+	return func() {}, nil
+}
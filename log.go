@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// logJSON makes goaci report what it does as JSON objects, one per line,
+// instead of text
+var logJSON bool
+
+// stdout and stderr are where goaci reports the results of the build and
+// what it does, including the output of the commands it runs. With -log-file
+// they are teed to logFile.
+var (
+	stdout  io.Writer = os.Stdout
+	stderr  io.Writer = os.Stderr
+	logFile *os.File
+)
+
+// openLogFile makes everything goaci reports go to the file path as well
+func openLogFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	logFile = f
+	stdout = io.MultiWriter(os.Stdout, f)
+	stderr = io.MultiWriter(os.Stderr, f)
+	return nil
+}
+
+// logEvent is what is reported, as a JSON object, for every message
+type logEvent struct {
+	Time  time.Time `json:"time"`
+	Level string    `json:"level"`
+	Msg   string    `json:"msg"`
+	// Command is set for commands being run
+	Command []string `json:"command,omitempty"`
+	// Phase is set when a phase of the build begins or ends, and Duration
+	// to how long it took, in seconds, when it ends
+	Phase    string  `json:"phase,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+	// Stream is set for the output of commands, to stdout or stderr
+	Stream string `json:"stream,omitempty"`
+}
+
+// emit writes e to w as a line of JSON
+func emit(w io.Writer, e logEvent) {
+	e.Time = time.Now().UTC()
+	e.Msg = strings.TrimSuffix(e.Msg, "\n")
+	b, err := json.Marshal(e)
+	if err != nil {
+		// Nothing in an event can fail to marshal
+		panic(err)
+	}
+	fmt.Fprintln(w, string(b))
+}
+
+// info reports a result of the build, like a file written, on stdout
+func info(s string, i ...interface{}) {
+	s = fmt.Sprintf(s, i...)
+	if logJSON {
+		emit(stdout, logEvent{Level: "info", Msg: s})
+		return
+	}
+	fmt.Fprintln(stdout, s)
+}
+
+// logCommand reports, when debugging, that the command args is being run
+func logCommand(args []string) {
+	if !Debug {
+		return
+	}
+	if logJSON {
+		emit(stderr, logEvent{Level: "debug", Msg: "running command", Command: args})
+		return
+	}
+	debug("running command: ", strings.Join(args, " "))
+}
+
+// phase reports that the phase name of the build begins, and returns a
+// function reporting that it ends and how long it took
+func phase(name string) (end func()) {
+	start := time.Now()
+	logPhase(logEvent{Msg: "begin " + name, Phase: name})
+	return func() {
+		d := time.Since(start)
+		logPhase(logEvent{Msg: fmt.Sprintf("end %s (%v)", name, d.Round(time.Millisecond)), Phase: name, Duration: d.Seconds()})
+	}
+}
+
+// logPhase reports where a phase of the build begins or ends, on stderr, or
+// only in the log file with -quiet
+func logPhase(e logEvent) {
+	w := stderr
+	if Quiet {
+		// The log file gets it all the same
+		if logFile == nil {
+			return
+		}
+		w = logFile
+	}
+	if logJSON {
+		e.Level = "info"
+		emit(w, e)
+		return
+	}
+	logLine(w, e.Msg)
+}
+
+// logLine writes the text message s to w, prefixed with the time. Results
+// reported by info are not, so that scripts can read them as they are.
+func logLine(w io.Writer, s string) {
+	s = strings.TrimSuffix(s, "\n")
+	fmt.Fprintln(w, time.Now().Format("15:04:05.000 ")+s)
+}
+
+// commandStdout is where the standard output of the commands goaci runs goes
+func commandStdout() io.Writer {
+	w := stdout
+	if Quiet {
+		// The log file gets it all the same
+		if logFile == nil {
+			return ioutil.Discard
+		}
+		w = logFile
+	}
+	if logJSON {
+		return outputEvents{w, "stdout"}
+	}
+	return w
+}
+
+// commandStderr is where the standard error of the commands goaci runs goes
+func commandStderr() io.Writer {
+	if logJSON {
+		return outputEvents{stderr, "stderr"}
+	}
+	return stderr
+}
+
+// outputEvents reports what commands write to stream as events on w, one
+// per line, so that it doesn't get in the way of reading the others
+type outputEvents struct {
+	w      io.Writer
+	stream string
+}
+
+func (o outputEvents) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		emit(o.w, logEvent{Level: "output", Msg: line, Stream: o.stream})
+	}
+	return len(b), nil
+}
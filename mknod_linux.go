@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// mknod creates a device or FIFO at path like the one described by info.
+// Creating devices requires root.
+func mknod(path string, info os.FileInfo) error {
+	mode := uint32(info.Mode().Perm())
+	switch m := info.Mode(); {
+	case m&os.ModeNamedPipe != 0:
+		mode |= syscall.S_IFIFO
+	case m&os.ModeCharDevice != 0:
+		mode |= syscall.S_IFCHR
+	default:
+		mode |= syscall.S_IFBLK
+	}
+	var dev int
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		dev = int(st.Rdev)
+	}
+	return syscall.Mknod(path, mode, dev)
+}
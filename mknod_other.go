@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// mknod can't create devices or FIFOs outside of Linux
+func mknod(path string, info os.FileInfo) error {
+	return errors.New("creating devices and FIFOs is only supported on Linux")
+}
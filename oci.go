@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/appc/spec/schema"
+)
+
+const (
+	ociLayoutVersion     = "1.0.0"
+	ociIndexMediaType    = "application/vnd.oci.image.index.v1+json"
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType    = "application/vnd.oci.image.layer.v1.tar"
+
+	// ociRefNameAnnotation is the annotation of an image in the index
+	// holding its tag
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+	// ociLabelPrefix prefixes the names of appc labels when they are
+	// translated into OCI annotations
+	ociLabelPrefix = "org.appc.label."
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// ociImage is the image configuration; the same structure is used by Docker
+type ociImage struct {
+	Architecture string         `json:"architecture"`
+	OS           string         `json:"os"`
+	Config       ociImageConfig `json:"config"`
+	RootFS       ociRootFS      `json:"rootfs"`
+}
+
+type ociImageConfig struct {
+	User       string            `json:"User,omitempty"`
+	Env        []string          `json:"Env,omitempty"`
+	Entrypoint []string          `json:"Entrypoint,omitempty"`
+	Labels     map[string]string `json:"Labels,omitempty"`
+}
+
+type ociRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// ociImageFromManifest translates the parts of an ACI image manifest which
+// have an equivalent into an OCI image configuration. The rootfs of the
+// returned image is left empty.
+func ociImageFromManifest(im schema.ImageManifest) ociImage {
+	img := ociImage{
+		Architecture: labelValue(im, "arch"),
+		OS:           labelValue(im, "os"),
+		Config: ociImageConfig{
+			Labels: ociAnnotations(im),
+		},
+		RootFS: ociRootFS{Type: "layers"},
+	}
+	if app := im.App; app != nil {
+		img.Config.User = app.User + ":" + app.Group
+		img.Config.Entrypoint = []string(app.Exec)
+		for _, ev := range app.Environment {
+			img.Config.Env = append(img.Config.Env, ev.Name+"="+ev.Value)
+		}
+	}
+	return img
+}
+
+// ociAnnotations returns the name, labels and annotations of an image
+// manifest as OCI annotations
+func ociAnnotations(im schema.ImageManifest) map[string]string {
+	a := map[string]string{
+		"org.appc.name": im.Name.String(),
+	}
+	for _, l := range im.Labels {
+		a[ociLabelPrefix+l.Name.String()] = l.Value
+	}
+	for _, an := range im.Annotations {
+		a[an.Name.String()] = an.Value
+	}
+	return a
+}
+
+// labelValue returns the value of the named label of an image manifest, or
+// the empty string if it has no such label
+func labelValue(im schema.ImageManifest, name string) string {
+	for _, l := range im.Labels {
+		if l.Name.String() == name {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// writeOCILayout writes an OCI image layout to dir, with the root filesystem
+// fs as its only layer and a configuration translated from im
+func writeOCILayout(dir string, fs *rootfs, im schema.ImageManifest, compression string, level int, topts tarOptions) error {
+	blobdir := filepath.Join(dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobdir, 0755); err != nil {
+		return err
+	}
+
+	layer, diffID, err := writeLayerBlob(blobdir, fs, compression, level, topts)
+	if err != nil {
+		return err
+	}
+	img := ociImageFromManifest(im)
+	img.RootFS.DiffIDs = []string{diffID}
+	config, err := writeJSONBlob(blobdir, ociConfigMediaType, img)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := writeJSONBlob(blobdir, ociManifestMediaType, ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        config,
+		Layers:        []ociDescriptor{layer},
+		Annotations:   ociAnnotations(im),
+	})
+	if err != nil {
+		return err
+	}
+	manifest.Annotations = map[string]string{
+		ociRefNameAnnotation: labelValue(im, "version"),
+	}
+
+	index := ociIndex{
+		SchemaVersion: 2,
+		MediaType:     ociIndexMediaType,
+		Manifests:     []ociDescriptor{manifest},
+	}
+	if err := writeJSON(filepath.Join(dir, "index.json"), index); err != nil {
+		return err
+	}
+	return writeJSON(filepath.Join(dir, "oci-layout"), map[string]string{
+		"imageLayoutVersion": ociLayoutVersion,
+	})
+}
+
+// writeOCIArchive builds an OCI image layout in the scratch directory dir and
+// writes it as a tarball to w
+func writeOCIArchive(w io.Writer, dir string, fs *rootfs, im schema.ImageManifest, compression string, level int, topts tarOptions) error {
+	if err := writeOCILayout(dir, fs, im, compression, level, topts); err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	if err := tarDir(tw, dir, topts); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeLayerBlob writes the root filesystem fs as a (possibly compressed) layer
+// tarball into blobdir, named after its digest. It returns the descriptor of
+// the blob and the digest of the uncompressed tarball.
+func writeLayerBlob(blobdir string, fs *rootfs, compression string, level int, topts tarOptions) (ociDescriptor, string, error) {
+	var desc ociDescriptor
+	f, err := ioutil.TempFile(blobdir, "layer")
+	if err != nil {
+		return desc, "", err
+	}
+	defer f.Close()
+	if err := f.Chmod(0644); err != nil {
+		return desc, "", err
+	}
+
+	blobHash := sha256.New()
+	fw := &countingWriter{w: io.MultiWriter(f, blobHash)}
+	cw, err := newCompressor(fw, compression, level)
+	if err != nil {
+		return desc, "", err
+	}
+	tarHash := sha256.New()
+	tw := tar.NewWriter(io.MultiWriter(cw, tarHash))
+	if err := fs.writeTar(tw, "", topts); err != nil {
+		return desc, "", err
+	}
+	if err := tw.Close(); err != nil {
+		return desc, "", err
+	}
+	if err := cw.Close(); err != nil {
+		return desc, "", err
+	}
+
+	sum := hex.EncodeToString(blobHash.Sum(nil))
+	if err := os.Rename(f.Name(), filepath.Join(blobdir, sum)); err != nil {
+		return desc, "", err
+	}
+	desc.MediaType = ociLayerMediaType
+	if compression == "gzip" {
+		desc.MediaType += "+gzip"
+	}
+	desc.Digest = "sha256:" + sum
+	desc.Size = fw.n
+	return desc, "sha256:" + hex.EncodeToString(tarHash.Sum(nil)), nil
+}
+
+// writeJSONBlob marshals v into blobdir, named after its digest
+func writeJSONBlob(blobdir, mediaType string, v interface{}) (ociDescriptor, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	sum := sha256.Sum256(b)
+	desc := ociDescriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + hex.EncodeToString(sum[:]),
+		Size:      int64(len(b)),
+	}
+	return desc, ioutil.WriteFile(filepath.Join(blobdir, hex.EncodeToString(sum[:])), b, 0644)
+}
+
+func writeJSON(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
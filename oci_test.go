@@ -0,0 +1,161 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+// testManifest returns the manifest of an image running /app
+func testManifest(t *testing.T) schema.ImageManifest {
+	name, err := types.NewACName("example.com/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return schema.ImageManifest{
+		ACKind:    types.ACKind("ImageManifest"),
+		ACVersion: schema.AppContainerVersion,
+		Name:      *name,
+		Labels: types.Labels{
+			{Name: "version", Value: "v1.0"},
+			{Name: "os", Value: "linux"},
+			{Name: "arch", Value: "amd64"},
+		},
+		App: &types.App{
+			Exec:  types.Exec{"/app"},
+			User:  "0",
+			Group: "0",
+		},
+	}
+}
+
+// readBlob reads the blob desc refers to from the OCI image layout in dir,
+// checking its digest and size
+func readBlob(t *testing.T, dir string, desc ociDescriptor) []byte {
+	var sum string
+	if _, err := fmt.Sscanf(desc.Digest, "sha256:%s", &sum); err != nil {
+		t.Fatalf("digest %q: %v", desc.Digest, err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "blobs", "sha256", sum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprintf("sha256:%x", sha256.Sum256(b)); got != desc.Digest || int64(len(b)) != desc.Size {
+		t.Errorf("blob %s has digest %s and size %d, want size %d", desc.Digest, got, len(b), desc.Size)
+	}
+	return b
+}
+
+// tarNames returns the names of the entries of the tarball b, and the
+// contents of its regular files
+func tarNames(t *testing.T, b []byte) ([]string, map[string]string) {
+	var names []string
+	files := map[string]string{}
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names, files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.Typeflag == tar.TypeReg {
+			c, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[hdr.Name] = string(c)
+		}
+	}
+}
+
+func TestWriteOCILayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goaci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rfs, layout := filepath.Join(dir, "rootfs"), filepath.Join(dir, "layout")
+	if err := os.MkdirAll(filepath.Join(rfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rfs, "app"), []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fs := newRootfs()
+	if _, err := fs.addTree("", rfs); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeOCILayout(layout, fs, testManifest(t), "gzip", 0, tarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(layout, "oci-layout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"imageLayoutVersion":"1.0.0"}`; string(b) != want {
+		t.Errorf("oci-layout = %s, want %s", b, want)
+	}
+	var index ociIndex
+	if b, err = ioutil.ReadFile(filepath.Join(layout, "index.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 1 || index.Manifests[0].Annotations[ociRefNameAnnotation] != "v1.0" {
+		t.Fatalf("index manifests = %+v, want one tagged v1.0", index.Manifests)
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(readBlob(t, layout, index.Manifests[0]), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Annotations["org.appc.name"] != "example.com/app" || len(manifest.Layers) != 1 {
+		t.Fatalf("manifest = %+v, want one layer and the name annotated", manifest)
+	}
+	var img ociImage
+	if err := json.Unmarshal(readBlob(t, layout, manifest.Config), &img); err != nil {
+		t.Fatal(err)
+	}
+	if img.OS != "linux" || img.Architecture != "amd64" || !reflect.DeepEqual(img.Config.Entrypoint, []string{"/app"}) {
+		t.Errorf("image configuration = %+v, want linux/amd64 running /app", img)
+	}
+
+	layer := manifest.Layers[0]
+	if layer.MediaType != ociLayerMediaType+"+gzip" {
+		t.Errorf("layer media type = %s, want %s+gzip", layer.MediaType, ociLayerMediaType)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(readBlob(t, layout, layer)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarball, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffID := fmt.Sprintf("sha256:%x", sha256.Sum256(tarball)); !reflect.DeepEqual(img.RootFS.DiffIDs, []string{diffID}) {
+		t.Errorf("diff IDs = %q, want the digest of the uncompressed layer, %s", img.RootFS.DiffIDs, diffID)
+	}
+	names, files := tarNames(t, tarball)
+	if want := []string{"app", "etc/"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("layer entries = %q, want %q", names, want)
+	}
+	if files["app"] != "binary" {
+		t.Errorf("app in the layer holds %q", files["app"])
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// startProfiling starts writing a CPU profile of goaci to cpuprofile, and
+// makes it write a memory profile to memprofile when it exits, if they are
+// set
+func startProfiling(cpuprofile, memprofile string) error {
+	if cpuprofile != "" {
+		f, err := os.Create(cpuprofile)
+		if err != nil {
+			return err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return err
+		}
+		atExit(func() {
+			pprof.StopCPUProfile()
+			f.Close()
+		})
+	}
+	if memprofile != "" {
+		f, err := os.Create(memprofile)
+		if err != nil {
+			return err
+		}
+		atExit(func() {
+			// Up to date statistics need a garbage collection
+			runtime.GC()
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				warn("error writing memory profile: %v", err)
+			}
+			f.Close()
+		})
+	}
+	return nil
+}
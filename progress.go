@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often progress is reported when stderr is not a
+// terminal, where every report takes a line
+const progressInterval = 5 * time.Second
+
+// progress reports how far along a slow phase of the build is: on a
+// terminal as a progress bar redrawn in place, and otherwise as a line every
+// progressInterval. Nothing is reported with -quiet.
+type progress struct {
+	what string
+	// total is the number of bytes the phase has to process, or 0 if it
+	// is not known in advance
+	total int64
+	start time.Time
+
+	mu   sync.Mutex
+	n    int64
+	last time.Time
+	tty  bool
+	stop chan struct{}
+}
+
+func newProgress(what string, total int64) *progress {
+	now := time.Now()
+	p := &progress{what: what, total: total, start: now, last: now}
+	if fi, err := os.Stderr.Stat(); err == nil {
+		p.tty = fi.Mode()&os.ModeCharDevice != 0 && !logJSON
+	}
+	return p
+}
+
+// startProgress starts reporting the time spent in a phase whose progress
+// can't be measured, like running a command, until done is called
+func startProgress(what string) *progress {
+	p := newProgress(what, 0)
+	p.stop = make(chan struct{})
+	go func() {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				p.add(0)
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// add records that n more bytes were processed
+func (p *progress) add(n int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.n += n
+	now := time.Now()
+	interval := progressInterval
+	if p.tty {
+		interval = 100 * time.Millisecond
+	}
+	if now.Sub(p.last) < interval {
+		return
+	}
+	p.last = now
+	p.report(false)
+}
+
+// done reports the end of the phase
+func (p *progress) done() {
+	if p == nil {
+		return
+	}
+	if p.stop != nil {
+		close(p.stop)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tty {
+		p.report(true)
+	}
+}
+
+// report tells how far along p is. Progress is reported with -quiet, too,
+// which only silences the commands goaci runs.
+func (p *progress) report(final bool) {
+	elapsed := time.Since(p.start).Truncate(time.Second)
+	var s string
+	switch {
+	case p.stop != nil:
+		s = fmt.Sprintf("%s (%v)", p.what, elapsed)
+	case p.total > 0:
+		pct := int(p.n * 100 / p.total)
+		if pct > 100 {
+			pct = 100
+		}
+		s = fmt.Sprintf("%s: %s of %s (%d%%)", p.what, formatBytes(p.n), formatBytes(p.total), pct)
+		if p.tty {
+			const width = 30
+			bar := strings.Repeat("=", pct*width/100) + strings.Repeat(" ", width-pct*width/100)
+			s = fmt.Sprintf("%s: [%s] %s of %s", p.what, bar, formatBytes(p.n), formatBytes(p.total))
+		}
+	default:
+		s = fmt.Sprintf("%s: %s", p.what, formatBytes(p.n))
+	}
+	switch {
+	case logJSON:
+		emit(stderr, logEvent{Level: "info", Msg: s})
+	case p.tty:
+		// Clear what is left of a longer previous line. The bar is
+		// only redrawn on the terminal, the log file just gets where
+		// it ended.
+		fmt.Fprintf(os.Stderr, "\r%s\033[K", s)
+		if final {
+			fmt.Fprintln(os.Stderr)
+			if logFile != nil {
+				logLine(logFile, s)
+			}
+		}
+	default:
+		logLine(stderr, s)
+	}
+}
+
+// formatBytes formats a number of bytes for humans, in binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// pushImage uploads the image at path, together with the files derived from
+// it (e.g. its signature, named path.asc), to dest. If dest ends with a
+// slash the files keep their names, otherwise dest names the image and the
+// derived files are named after it with their own suffix.
+func pushImage(dest, path string, derived []string) error {
+	for _, p := range append([]string{path}, derived...) {
+		var to string
+		if strings.HasSuffix(dest, "/") {
+			to = dest + filepath.Base(p)
+		} else {
+			to = dest + strings.TrimPrefix(p, path)
+		}
+		if err := pushFile(p, to); err != nil {
+			return fmt.Errorf("error uploading %s: %v", p, err)
+		}
+		info("Uploaded %s", to)
+	}
+	return nil
+}
+
+// pushFile uploads the file at path to dest, which is either an http(s) URL
+// the file is PUT to, or an s3:// or gs:// URL the file is copied to with the
+// respective command line tool.
+func pushFile(path, dest string) error {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return httpPut(path, dest)
+	case "s3":
+		return runCopyTool("aws", "s3", "cp", path, dest)
+	case "gs":
+		return runCopyTool("gsutil", "cp", path, dest)
+	}
+	return fmt.Errorf("unsupported upload destination %q (must be http, https, s3 or gs)", dest)
+}
+
+func httpPut(path, dest string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", dest, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	debug("uploading to:", dest)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("server responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// runCopyTool runs the named tool with the given arguments
+func runCopyTool(tool string, args ...string) error {
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		return fmt.Errorf("could not find `%s` in path", tool)
+	}
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stderr = commandStderr()
+	cmd.Stdout = commandStdout()
+	logCommand(cmd.Args)
+	return cmd.Run()
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// cloneFile isn't supported outside of Linux, so files are always copied
+func cloneFile(dst, src *os.File) error {
+	return errors.New("reflinks are not supported")
+}
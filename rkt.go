@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+)
+
+// rktFetch fetches the ACI at path into the local rkt store, so that
+// it can be run right away. The image is not verified, as it was just
+// built locally.
+func rktFetch(path string) error {
+	rktcmd, err := exec.LookPath("rkt")
+	if err != nil {
+		return fmt.Errorf("could not find `rkt` in path")
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, rktcmd, "fetch", "--insecure-options=image", "file://"+abs)
+	cmd.Stderr = commandStderr()
+	cmd.Stdout = commandStdout()
+	logCommand(cmd.Args)
+	return cmd.Run()
+}
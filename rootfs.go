@@ -0,0 +1,819 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rootfs describes the root filesystem of an image as a mapping from paths in
+// the image to the files on the build host they are read from. This way files
+// are streamed straight into the image archive, instead of first being copied
+// into a staging directory and then read again from there.
+type rootfs struct {
+	// entries maps slash-separated paths relative to the root of the image
+	// to the file they are read from; directories which only exist to
+	// hold other entries are mapped to the empty string
+	entries map[string]string
+	// excludes are patterns (see matchGlob) of the absolute host paths
+	// addTree leaves out
+	excludes []string
+	// skipSpecial makes addTree leave out devices and FIFOs
+	skipSpecial bool
+	// linkFiles makes writeDir hard link regular files instead of copying
+	// them, where they are on the same filesystem
+	linkFiles bool
+	// symlinks overrides the targets of symlinks, which are otherwise
+	// recreated as they are on the build host
+	symlinks map[string]string
+	// modes overrides the permissions of entries, which are otherwise
+	// those of the files they are read from
+	modes map[string]os.FileMode
+	// deps are the entries added because other entries need them, like
+	// shared libraries and script interpreters, see addDep
+	deps map[string]bool
+	// progress, if set, is told about the contents of the files written
+	// by writeTar and writeDir
+	progress *progress
+}
+
+// permBits are the parts of a file mode which can be overridden with chmod
+const permBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+func newRootfs() *rootfs {
+	return &rootfs{
+		entries:  map[string]string{},
+		symlinks: map[string]string{},
+		modes:    map[string]os.FileMode{},
+		deps:     map[string]bool{},
+	}
+}
+
+// add adds the file at src to the image as p, along with any missing parent
+// directories. Symlinks are not followed and directories are added without
+// their contents.
+func (r *rootfs) add(p, src string) {
+	p = cleanRootfsPath(p)
+	if p == "" {
+		return
+	}
+	r.entries[p] = src
+	for d := path.Dir(p); d != "."; d = path.Dir(d) {
+		if _, ok := r.entries[d]; ok {
+			break
+		}
+		r.entries[d] = ""
+	}
+}
+
+// hasMode reports whether the permissions of the entry at p are overridden
+func (r *rootfs) hasMode(p string) bool {
+	_, ok := r.modes[p]
+	return ok
+}
+
+// has reports whether the image has an entry at p
+func (r *rootfs) has(p string) bool {
+	_, ok := r.entries[cleanRootfsPath(p)]
+	return ok
+}
+
+// addDep adds the file at src to the image as p, like add, and marks it as
+// a dependency of other entries, which splitDeps moves to an image of its own
+func (r *rootfs) addDep(p, src string) {
+	r.add(p, src)
+	r.deps[cleanRootfsPath(p)] = true
+}
+
+// splitDeps moves the entries added with addDep, with their permissions and
+// symlink targets, to a new rootfs and returns it. The directories holding
+// them are left in r, so that those created with mkdir are kept.
+func (r *rootfs) splitDeps() *rootfs {
+	d := newRootfs()
+	d.skipSpecial, d.linkFiles = r.skipSpecial, r.linkFiles
+	for p := range r.deps {
+		src, ok := r.entries[p]
+		if !ok {
+			continue
+		}
+		d.add(p, src)
+		if m, ok := r.modes[p]; ok {
+			d.modes[p] = m
+			delete(r.modes, p)
+		}
+		if l, ok := r.symlinks[p]; ok {
+			d.symlinks[p] = l
+			delete(r.symlinks, p)
+		}
+		delete(r.entries, p)
+	}
+	r.deps = map[string]bool{}
+	return d
+}
+
+// mkdir adds an empty directory to the image as p, with the permissions mode
+// if it is not 0. Existing directories are left as they are, apart from their
+// permissions.
+func (r *rootfs) mkdir(p string, mode os.FileMode) error {
+	p = cleanRootfsPath(p)
+	if p == "" {
+		return fmt.Errorf("can't create the root directory")
+	}
+	if src, ok := r.entries[p]; !ok {
+		r.add(p, "")
+	} else if src != "" {
+		info, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("/%s is already in the image and is not a directory", p)
+		}
+	}
+	if mode == 0 {
+		return nil
+	}
+	return r.chmod(p, mode)
+}
+
+// chmod gives the entry at p the permissions mode in the image. Symlinks
+// have no permissions of their own and can't be changed.
+func (r *rootfs) chmod(p string, mode os.FileMode) error {
+	p = cleanRootfsPath(p)
+	src, ok := r.entries[p]
+	if !ok {
+		return fmt.Errorf("/%s is not in the image", p)
+	}
+	if src != "" {
+		info, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("/%s is a symlink", p)
+		}
+	}
+	r.modes[p] = mode & permBits
+	return nil
+}
+
+// parseMode parses an octal file mode, like chmod(1) does, including the
+// setuid (4000), setgid (2000) and sticky (1000) bits
+func parseMode(s string) (os.FileMode, error) {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 07777 {
+		return 0, fmt.Errorf("bad mode %q: must be an octal number up to 7777", s)
+	}
+	mode := os.FileMode(n) & os.ModePerm
+	if n&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if n&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if n&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
+
+// modeInfo is a os.FileInfo whose permissions are overridden
+type modeInfo struct {
+	os.FileInfo
+	perm os.FileMode
+}
+
+func (i modeInfo) Mode() os.FileMode {
+	return i.FileInfo.Mode()&^permBits | i.perm
+}
+
+// lstat describes the file the entry at p is read from, with the
+// permissions it has in the image
+func (r *rootfs) lstat(p string) (os.FileInfo, error) {
+	info, err := os.Lstat(r.entries[p])
+	if err != nil {
+		return nil, err
+	}
+	if mode, ok := r.modes[p]; ok {
+		return modeInfo{info, mode}, nil
+	}
+	return info, nil
+}
+
+// dirMode returns the permissions in the image of the directory entry at p,
+// which has no counterpart on disk
+func (r *rootfs) dirMode(p string) os.FileMode {
+	if mode, ok := r.modes[p]; ok {
+		return mode
+	}
+	return 0755
+}
+
+// excluded reports whether the absolute host path abs matches one of the
+// excludes
+func (r *rootfs) excluded(abs string) (bool, error) {
+	for _, e := range r.excludes {
+		ok, err := matchGlob(e, abs)
+		if err != nil {
+			return false, fmt.Errorf("bad exclude %q: %v", e, err)
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// excludedBelow reports whether one of the directories holding p, up to and
+// including base, is excluded
+func (r *rootfs) excludedBelow(base, p string) (bool, error) {
+	base, err := filepath.Abs(base)
+	if err != nil {
+		return false, err
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return false, err
+	}
+	for d := filepath.Dir(abs); within(base, d); d = filepath.Dir(d) {
+		if ok, err := r.excluded(d); ok || err != nil {
+			return ok, err
+		}
+		if d == base {
+			break
+		}
+	}
+	return false, nil
+}
+
+// addTree adds src, and everything below it if it is a directory, to the
+// image as p, and returns the paths in the image of the regular files added.
+// Excluded files are skipped along with their contents, as are sockets, which
+// have no place in an image.
+func (r *rootfs) addTree(p, src string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(src, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		abs, err := filepath.Abs(fpath)
+		if err != nil {
+			return err
+		}
+		if ok, err := r.excluded(abs); err != nil {
+			return err
+		} else if ok {
+			debug("excluding from rootfs: ", fpath)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch mode := info.Mode(); {
+		case mode&os.ModeSocket != 0:
+			warn("skipping socket %s", fpath)
+			return nil
+		case mode&(os.ModeDevice|os.ModeNamedPipe) != 0 && r.skipSpecial:
+			debug("skipping special file: ", fpath)
+			return nil
+		}
+		relpath, err := filepath.Rel(src, fpath)
+		if err != nil {
+			return err
+		}
+		ipath := path.Join(p, filepath.ToSlash(relpath))
+		r.add(ipath, fpath)
+		if info.Mode().IsRegular() {
+			files = append(files, cleanRootfsPath(ipath))
+		}
+		return nil
+	})
+	return files, err
+}
+
+// cleanRootfsPath turns p into the form used as key of the rootfs entries:
+// slash-separated, relative to the root of the image and without any ".."
+func cleanRootfsPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(p)), "/")
+}
+
+// paths returns the paths of all entries, in lexical order; directories
+// always come before their contents
+func (r *rootfs) paths() []string {
+	paths := make([]string, 0, len(r.entries))
+	for p := range r.entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// readlink returns the target of the symlink at p in the image
+func (r *rootfs) readlink(p string) (string, error) {
+	if link, ok := r.symlinks[p]; ok {
+		return link, nil
+	}
+	return os.Readlink(r.entries[p])
+}
+
+// resolve follows the symlinks in the image making up p, the way the kernel
+// would in a container of the image, and returns the path of the entry p
+// stands for. ok is false if p leads to nothing in the image.
+func (r *rootfs) resolve(p string) (resolved string, ok bool) {
+	p = cleanRootfsPath(p)
+	// As many symlinks as Linux follows before giving up with ELOOP
+	for hops := 0; hops <= 40; hops++ {
+		elems := strings.Split(p, "/")
+		link, i := "", 0
+		for cur := ""; i < len(elems) && p != ""; i++ {
+			cur = path.Join(cur, elems[i])
+			src, ok := r.entries[cur]
+			if !ok {
+				return "", false
+			}
+			if src == "" {
+				continue
+			}
+			info, err := os.Lstat(src)
+			if err != nil {
+				return "", false
+			}
+			if info.Mode()&os.ModeSymlink == 0 {
+				continue
+			}
+			if link, err = r.readlink(cur); err != nil {
+				return "", false
+			}
+			if !path.IsAbs(link) {
+				link = path.Join("/", path.Dir(cur), link)
+			}
+			break
+		}
+		if link == "" {
+			return p, true
+		}
+		p = cleanRootfsPath(path.Join(append([]string{link}, elems[i+1:]...)...))
+	}
+	return "", false
+}
+
+// checkSymlinks looks for symlinks which would point outside of the image.
+// Relative symlinks climbing above the root of the image are an error, as
+// they would escape it when extracted. Absolute symlinks are resolved within
+// the image at runtime but not on the build host, so they are rewritten into
+// relative ones if rewriteAbsolute is set. Symlinks to files which aren't in
+// the image are warned about.
+func (r *rootfs) checkSymlinks(rewriteAbsolute bool) error {
+	for _, p := range r.paths() {
+		src := r.entries[p]
+		if src == "" {
+			continue
+		}
+		info, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		link, err := r.readlink(p)
+		if err != nil {
+			return err
+		}
+		dir := path.Dir("/" + p)
+		if !path.IsAbs(link) && escapesRoot(dir, link) {
+			return fmt.Errorf("symlink /%s -> %s (from %s) points outside of the image", p, link, src)
+		}
+		target := path.Join(dir, link)
+		if path.IsAbs(link) {
+			target = path.Clean(link)
+			if rewriteAbsolute {
+				rel, err := filepath.Rel(dir, target)
+				if err != nil {
+					return err
+				}
+				debug("rewriting symlink /", p, " -> ", link, " to ", rel)
+				r.symlinks[p] = rel
+			}
+		}
+		if target != "/" && !r.has(target) {
+			warn("symlink /%s points to %s, which is not in the image", p, target)
+		}
+	}
+	return nil
+}
+
+// escapesRoot reports whether the relative symlink target, in the directory
+// dir, climbs above the root directory
+func escapesRoot(dir, target string) bool {
+	depth := 0
+	for _, e := range strings.Split(strings.Trim(dir, "/")+"/"+target, "/") {
+		switch e {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	return false
+}
+
+// writeTar adds the root filesystem to tw, below the directory prefix if it
+// is not empty
+func (r *rootfs) writeTar(tw *tar.Writer, prefix string, topts tarOptions) error {
+	if prefix != "" {
+		if err := tarDirEntry(tw, prefix, 0755, topts); err != nil {
+			return err
+		}
+	}
+	dups, err := r.duplicates(topts)
+	if err != nil {
+		return err
+	}
+	// Names of the entries written for files which have several links,
+	// so that further links to them are written as hard links
+	links := map[fileID]string{}
+	for _, p := range r.paths() {
+		name := path.Join(prefix, p)
+		src := r.entries[p]
+		if src == "" {
+			if err := tarDirEntry(tw, name, r.dirMode(p), topts); err != nil {
+				return err
+			}
+			continue
+		}
+		info, err := r.lstat(p)
+		if err != nil {
+			return err
+		}
+		if first, ok := dups[p]; ok {
+			debug("adding ", p, " as a hard link to its duplicate ", first)
+			if err := tarHardlink(tw, name, path.Join(prefix, first), info, topts); err != nil {
+				return err
+			}
+			continue
+		}
+		// Links with their own permissions can't share them with others
+		if id, ok := hardlinkID(info); ok && !r.hasMode(p) {
+			if target, ok := links[id]; ok {
+				if err := tarHardlink(tw, name, target, info, topts); err != nil {
+					return err
+				}
+				continue
+			}
+			links[id] = name
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err := r.readlink(p)
+			if err != nil {
+				return err
+			}
+			hdr, err := tarHeader(name, info, link, topts)
+			if err != nil {
+				return err
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := tarFile(tw, name, src, info, topts); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			r.progress.add(info.Size())
+		}
+	}
+	return nil
+}
+
+// size returns the total size of the regular files in the image, counting
+// every link to the same file
+func (r *rootfs) size() (int64, error) {
+	var n int64
+	for p, src := range r.entries {
+		if src == "" {
+			continue
+		}
+		info, err := r.lstat(p)
+		if err != nil {
+			return 0, err
+		}
+		if info.Mode().IsRegular() {
+			n += info.Size()
+		}
+	}
+	return n, nil
+}
+
+// duplicates finds regular files whose contents, and whatever else of them
+// ends up in a tar header, are identical to those of another file, and maps
+// their paths to the path of the first such file, so that they can be stored
+// only once. Only files sharing their size with others are read.
+func (r *rootfs) duplicates(topts tarOptions) (map[string]string, error) {
+	type candidate struct {
+		p    string
+		info os.FileInfo
+	}
+	bySize := map[int64][]candidate{}
+	for _, p := range r.paths() {
+		if r.entries[p] == "" {
+			continue
+		}
+		info, err := r.lstat(p)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode().IsRegular() && info.Size() > 0 {
+			bySize[info.Size()] = append(bySize[info.Size()], candidate{p, info})
+		}
+	}
+
+	// key holds everything which must match for a file to be stored as a
+	// hard link to another
+	type key struct {
+		sum      [sha256.Size]byte
+		mode     os.FileMode
+		uid, gid int
+		mtime    time.Time
+	}
+	dups := map[string]string{}
+	for _, cs := range bySize {
+		if len(cs) < 2 {
+			continue
+		}
+		firsts := map[key]string{}
+		for _, c := range cs {
+			sum, err := fileSHA256(r.entries[c.p])
+			if err != nil {
+				return nil, err
+			}
+			k := key{sum: sum, mode: c.info.Mode()}
+			if topts.preserveOwnership {
+				k.uid, k.gid, _ = fileOwner(c.info)
+			}
+			if topts.preserveTimes {
+				k.mtime = c.info.ModTime()
+			}
+			// Candidates are in lexical order, so the first one is
+			// written before its duplicates
+			if first, ok := firsts[k]; ok {
+				dups[c.p] = first
+			} else {
+				firsts[k] = c.p
+			}
+		}
+	}
+	return dups, nil
+}
+
+// fileSHA256 returns the SHA-256 digest of the contents of the file at path
+func fileSHA256(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// writeDir copies the root filesystem into dir. Only the permissions of
+// files are kept, unless preserveAttrs is set: then the owner (if running as
+// root), modification time and setuid, setgid and sticky bits are kept, too.
+// With update, dir may hold a root filesystem written before, which is
+// updated in place: only files which changed are copied again.
+func (r *rootfs) writeDir(dir string, preserveAttrs, update bool) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if update {
+		if err := r.removeStale(dir, preserveAttrs); err != nil {
+			return err
+		}
+	}
+	links := map[fileID]string{}
+	for _, p := range r.paths() {
+		target := filepath.Join(dir, filepath.FromSlash(p))
+		src := r.entries[p]
+		// What is left over from before is up to date
+		exists := false
+		if update {
+			_, err := os.Lstat(target)
+			exists = err == nil
+		}
+		if src == "" {
+			if !exists {
+				if err := os.Mkdir(target, 0755); err != nil {
+					return err
+				}
+			}
+			if r.hasMode(p) {
+				if err := os.Chmod(target, r.dirMode(p)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		info, err := r.lstat(p)
+		if err != nil {
+			return err
+		}
+		if id, ok := hardlinkID(info); ok && !r.hasMode(p) {
+			if first, ok := links[id]; ok {
+				if err := os.Link(first, target); err != nil {
+					return err
+				}
+				continue
+			}
+			links[id] = target
+		}
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if !exists {
+				if err := os.Mkdir(target, mode.Perm()); err != nil {
+					return err
+				}
+			}
+			if err := os.Chmod(target, mode.Perm()); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			link, err := r.readlink(p)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			// Files with their own permissions in the image
+			// can't share them with the file they are read from
+			linked := false
+			if !exists && r.linkFiles && !r.hasMode(p) {
+				// Linking fails across filesystems
+				linked = os.Link(src, target) == nil
+			}
+			if !exists && !linked {
+				if err := copyRegularFile(src, target, mode.Perm()); err != nil {
+					return err
+				}
+			}
+			// Only the contents of what is left over were compared
+			if exists {
+				if err := os.Chmod(target, mode.Perm()); err != nil {
+					return err
+				}
+			}
+			r.progress.add(info.Size())
+		case mode&(os.ModeDevice|os.ModeNamedPipe) != 0:
+			if err := mknod(target, info); err != nil {
+				return fmt.Errorf("can't create %s: %v", target, err)
+			}
+		default:
+			return fmt.Errorf("can't copy %s: unsupported file type %v", src, mode)
+		}
+		if preserveAttrs {
+			if err := copyOwnerAndMode(target, info); err != nil {
+				return err
+			}
+		} else if r.hasMode(p) {
+			if err := os.Chmod(target, info.Mode()&permBits); err != nil {
+				return err
+			}
+		}
+	}
+	if !preserveAttrs {
+		return nil
+	}
+	// Set the times last, and on directories after their contents, as
+	// adding files to a directory changes its modification time
+	paths := r.paths()
+	for i := len(paths) - 1; i >= 0; i-- {
+		src := r.entries[paths[i]]
+		if src == "" {
+			continue
+		}
+		info, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(paths[i]))
+		if err := os.Chtimes(target, info.ModTime(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeStale removes what differs from the image in the root filesystem
+// written to dir before: files which aren't in the image anymore, or have
+// changed, and entries which are of another type now. Directories are kept
+// and only get their permissions set again, and symlinks, devices and
+// further hard links to a file are always created anew, as that is cheap.
+func (r *rootfs) removeStale(dir string, preserveAttrs bool) error {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if _, ok := r.entries[filepath.ToSlash(rel)]; ok {
+			return nil
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	links := map[fileID]bool{}
+	for _, p := range r.paths() {
+		target := filepath.Join(dir, filepath.FromSlash(p))
+		old, err := os.Lstat(target)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		keep := false
+		if src := r.entries[p]; src == "" {
+			keep = old.IsDir()
+		} else {
+			info, err := r.lstat(p)
+			if err != nil {
+				return err
+			}
+			first := true
+			if id, ok := hardlinkID(info); ok && !r.hasMode(p) {
+				first = !links[id]
+				links[id] = true
+			}
+			switch mode := info.Mode(); {
+			case mode.IsDir():
+				keep = old.IsDir()
+			case mode.IsRegular() && first && old.Mode().IsRegular():
+				if keep, err = sameContents(target, src, old, info, preserveAttrs); err != nil {
+					return err
+				}
+			}
+		}
+		if !keep {
+			debug("replacing ", p)
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sameContents reports whether the regular file target, described by old,
+// holds the contents of the file src, described by info. With preserveAttrs
+// the copy has the modification time of src, so the sizes and times are
+// compared; otherwise the contents are.
+func sameContents(target, src string, old, info os.FileInfo, preserveAttrs bool) (bool, error) {
+	if old.Size() != info.Size() {
+		return false, nil
+	}
+	if preserveAttrs {
+		return old.ModTime().Equal(info.ModTime()), nil
+	}
+	a, err := fileSHA256(target)
+	if err != nil {
+		return false, err
+	}
+	b, err := fileSHA256(src)
+	if err != nil {
+		return false, err
+	}
+	return a == b, nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEscapesRoot(t *testing.T) {
+	tests := []struct {
+		dir, target string
+		want        bool
+	}{
+		{"usr/bin", "../lib/x", false},
+		{"usr/bin", "../../lib/x", false},
+		{"usr/bin", "../../../lib/x", true},
+		{"", "x", false},
+		{"", "..", true},
+		{"", "../x", true},
+		{"/usr/", "./../x", false},
+		{"usr", "a/../../..", true},
+		{"usr", "a/../..", false},
+		{"usr", "a//b/./../../..", false},
+	}
+	for _, tt := range tests {
+		if got := escapesRoot(tt.dir, tt.target); got != tt.want {
+			t.Errorf("escapesRoot(%q, %q) = %v, want %v", tt.dir, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goaci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file, link := filepath.Join(dir, "file"), filepath.Join(dir, "link")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The targets of the symlinks in the image are overridden
+	if err := os.Symlink("file", link); err != nil {
+		t.Fatal(err)
+	}
+	fs := newRootfs()
+	fs.add("lib/x86_64-linux-gnu/libc.so.6", file)
+	for p, target := range map[string]string{
+		"lib64":      "lib/x86_64-linux-gnu",
+		"usr/lib":    "../lib64",
+		"usr/lib64":  "/usr/lib",
+		"loop":       "/loop",
+		"up":         "../../../lib64",
+		"dangling":   "/nowhere",
+		"lib/libc.6": "x86_64-linux-gnu/libc.so.6",
+	} {
+		fs.add(p, link)
+		fs.symlinks[p] = target
+	}
+
+	tests := []struct {
+		p, want string
+		ok      bool
+	}{
+		{"/lib/x86_64-linux-gnu/libc.so.6", "lib/x86_64-linux-gnu/libc.so.6", true},
+		{"/lib64/libc.so.6", "lib/x86_64-linux-gnu/libc.so.6", true},
+		{"/usr/lib/libc.so.6", "lib/x86_64-linux-gnu/libc.so.6", true},
+		{"/usr/lib64/libc.so.6", "lib/x86_64-linux-gnu/libc.so.6", true},
+		{"/lib/libc.6", "lib/x86_64-linux-gnu/libc.so.6", true},
+		// Like the kernel, ".." at the root stays there
+		{"/up/libc.so.6", "lib/x86_64-linux-gnu/libc.so.6", true},
+		{"/usr/lib", "lib/x86_64-linux-gnu", true},
+		{"/lib64/missing.so", "", false},
+		{"/dangling", "", false},
+		{"/loop", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := fs.resolve(tt.p)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("resolve(%q) = %q, %v, want %q, %v", tt.p, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSplitDeps(t *testing.T) {
+	fs := newRootfs()
+	fs.add("app", "/build/app")
+	fs.add("etc/app.conf", "/src/app.conf")
+	fs.addDep("lib/libc.so.6", "/lib/libc.so.6")
+	fs.addDep("lib64/ld-linux-x86-64.so.2", "/lib64/ld-linux-x86-64.so.2")
+	fs.symlinks["lib64/ld-linux-x86-64.so.2"] = "../lib/ld.so"
+	fs.modes["lib/libc.so.6"] = 0755
+
+	deps := fs.splitDeps()
+	wantApp := map[string]string{
+		"app":          "/build/app",
+		"etc":          "",
+		"etc/app.conf": "/src/app.conf",
+		"lib":          "",
+		"lib64":        "",
+	}
+	if !reflect.DeepEqual(fs.entries, wantApp) {
+		t.Errorf("entries left = %q, want %q", fs.entries, wantApp)
+	}
+	wantDeps := map[string]string{
+		"lib":                        "",
+		"lib/libc.so.6":              "/lib/libc.so.6",
+		"lib64":                      "",
+		"lib64/ld-linux-x86-64.so.2": "/lib64/ld-linux-x86-64.so.2",
+	}
+	if !reflect.DeepEqual(deps.entries, wantDeps) {
+		t.Errorf("entries split off = %q, want %q", deps.entries, wantDeps)
+	}
+	if len(fs.modes) != 0 || len(fs.symlinks) != 0 {
+		t.Errorf("modes %v and symlinks %q of the dependencies left behind", fs.modes, fs.symlinks)
+	}
+	if deps.modes["lib/libc.so.6"] != 0755 || deps.symlinks["lib64/ld-linux-x86-64.so.2"] != "../lib/ld.so" {
+		t.Errorf("modes %v and symlinks %q not split off", deps.modes, deps.symlinks)
+	}
+	if len(fs.splitDeps().entries) != 0 {
+		t.Errorf("dependencies split off twice")
+	}
+}
+
+// tarLinks writes fs below rootfs/ and returns the hard links in the tarball,
+// mapped to their targets
+func tarLinks(t *testing.T, fs *rootfs) map[string]string {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := fs.writeTar(tw, "rootfs", tarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			links[hdr.Name] = hdr.Linkname
+		}
+	}
+	return links
+}
+
+func TestHardlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goaci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, "src/a", "src/c")
+	if err := os.Link(filepath.Join(dir, "src/a"), filepath.Join(dir, "src/b")); err != nil {
+		t.Skipf("cannot create hard links: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "src/a")); err != nil {
+		t.Fatal(err)
+	} else if _, ok := hardlinkID(info); !ok {
+		t.Skip("hard links are not recognized on this platform")
+	}
+	fs := newRootfs()
+	if _, err := fs.addTree("", filepath.Join(dir, "src")); err != nil {
+		t.Fatal(err)
+	}
+
+	links := tarLinks(t, fs)
+	if want := map[string]string{"rootfs/b": "rootfs/a"}; !reflect.DeepEqual(links, want) {
+		t.Errorf("hard links = %q, want %q", links, want)
+	}
+
+	out := filepath.Join(dir, "out")
+	if err := fs.writeDir(out, false, false); err != nil {
+		t.Fatal(err)
+	}
+	var infos []os.FileInfo
+	for _, f := range []string{"a", "b", "c"} {
+		info, err := os.Stat(filepath.Join(out, f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos = append(infos, info)
+	}
+	if !os.SameFile(infos[0], infos[1]) || os.SameFile(infos[0], infos[2]) {
+		t.Errorf("only a and b should be links to the same file in the written directory")
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goaci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for f, mode := range map[string]os.FileMode{"a": 0644, "b": 0644, "c": 0755, "d": 0644} {
+		contents := "same"
+		if f == "d" {
+			contents = "diff"
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(contents), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs := newRootfs()
+	fs.add("usr/lib/a", filepath.Join(dir, "a"))
+	fs.add("lib/b", filepath.Join(dir, "b"))
+	fs.add("lib/c", filepath.Join(dir, "c"))
+	fs.add("lib/d", filepath.Join(dir, "d"))
+	fs.add("lib/e", filepath.Join(dir, "a"))
+	// Files of the same contents but other permissions are kept apart
+	want := map[string]string{
+		"rootfs/usr/lib/a": "rootfs/lib/b",
+		"rootfs/lib/e":     "rootfs/lib/b",
+	}
+	if links := tarLinks(t, fs); !reflect.DeepEqual(links, want) {
+		t.Errorf("hard links = %q, want %q", links, want)
+	}
+	if err := fs.chmod("lib/e", 0755); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]string{
+		"rootfs/usr/lib/a": "rootfs/lib/b",
+		"rootfs/lib/e":     "rootfs/lib/c",
+	}
+	if links := tarLinks(t, fs); !reflect.DeepEqual(links, want) {
+		t.Errorf("hard links after chmod = %q, want %q", links, want)
+	}
+}
+
+func TestWriteDirUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goaci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, "src/keep", "src/change", "src/gone")
+	out := filepath.Join(dir, "rootfs")
+	fs := newRootfs()
+	if _, err := fs.addTree("bin", filepath.Join(dir, "src")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.writeDir(out, false, false); err != nil {
+		t.Fatal(err)
+	}
+	kept, err := os.Stat(filepath.Join(out, "bin", "keep"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "src", "change"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "src", "gone")); err != nil {
+		t.Fatal(err)
+	}
+	// Unchanged contents are kept, but the permissions are updated
+	if err := os.Chmod(filepath.Join(dir, "src", "keep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fs = newRootfs()
+	if _, err := fs.addTree("bin", filepath.Join(dir, "src")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.writeDir(out, false, true); err != nil {
+		t.Fatal(err)
+	}
+	// Unchanged files are left in place
+	if info, err := os.Stat(filepath.Join(out, "bin", "keep")); err != nil || !os.SameFile(info, kept) {
+		t.Errorf("unchanged file copied again (%v)", err)
+	}
+	if info, err := os.Stat(filepath.Join(out, "bin", "keep")); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("permissions of the unchanged file not updated (%v)", err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(out, "bin", "change")); err != nil || string(b) != "changed" {
+		t.Errorf("changed file holds %q (%v)", b, err)
+	}
+	if _, err := os.Lstat(filepath.Join(out, "bin", "gone")); !os.IsNotExist(err) {
+		t.Errorf("file removed from the image is still there (%v)", err)
+	}
+}
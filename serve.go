@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	commands["serve"] = runServe
+}
+
+// serveFlags are the flags builds submitted to goaci serve may use: those
+// which neither run commands on the server, like -asset-hook, -go-generate
+// or -run-tests, nor read or write its files, like -asset or -o. Flags given
+// to goaci serve itself apply to every build.
+var serveFlags = map[string]bool{
+	"all-binaries":      true,
+	"cgo":               true,
+	"compression":       true,
+	"compression-level": true,
+	"discovery-naming":  true,
+	"expect-commit":     true,
+	"forbid-dirty":      true,
+	"format":            true,
+	"go-tags":           true,
+	"image-version":     true,
+	"include-tzdata":    true,
+	"reproducible":      true,
+	"revision":          true,
+	"source-date-epoch": true,
+	"source-sha256":     true,
+	"stamp-version":     true,
+	"stub-etc":          true,
+	"use-vendor":        true,
+}
+
+// serveBuild is a build submitted to goaci serve, as reported by its API
+type serveBuild struct {
+	ID      string   `json:"id"`
+	Package string   `json:"package"`
+	Flags   []string `json:"flags"`
+	// Status is queued, running, succeeded or failed
+	Status string   `json:"status"`
+	Error  string   `json:"error,omitempty"`
+	Images []string `json:"images,omitempty"`
+
+	dir  string
+	done chan struct{}
+}
+
+// server runs the builds submitted to it, each with goaci anew, in a
+// directory of their own below dir, which holds their log and images
+type server struct {
+	dir  string
+	self string
+	// flags are those given to goaci serve, passed on to every build
+	flags []string
+	// slots limits how many builds run at once
+	slots chan struct{}
+
+	mu     sync.Mutex
+	builds map[string]*serveBuild
+}
+
+// runServe serves an HTTP API for building images:
+//
+//	POST /builds                 submits a build of {"package": ..., "flags": [...]}
+//	GET  /builds                 lists the builds
+//	GET  /builds/ID              reports a build
+//	GET  /builds/ID/log          streams the log of a build, until it is done
+//	GET  /builds/ID/images/NAME  downloads an image built
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", "localhost:8080", "address to serve the API on")
+	dir := fs.String("dir", "goaci-builds", "directory to keep the logs and images of the builds in")
+	parallel := fs.Int("parallel", 1, "how many builds to run at once")
+	fs.Parse(args)
+	if fs.NArg() > 0 || *parallel < 1 {
+		die("usage: goaci [flags] serve [-listen ADDRESS] [-dir DIR] [-parallel N]")
+	}
+	self, err := os.Executable()
+	if err != nil {
+		die(err.Error())
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		die(err.Error())
+	}
+	s := &server{
+		dir:    *dir,
+		self:   self,
+		flags:  commandFlags(args),
+		slots:  make(chan struct{}, *parallel),
+		builds: map[string]*serveBuild{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/builds", s.handleBuilds)
+	mux.HandleFunc("/builds/", s.handleBuild)
+	srv := &http.Server{Addr: *listen, Handler: mux}
+
+	// Running builds get interrupts from the terminal, too
+	handleInterrupts()
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	info("Serving on %s", *listen)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		die(err.Error())
+	}
+}
+
+func (s *server) handleBuilds(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		s.mu.Lock()
+		list := []serveBuild{}
+		for _, b := range s.builds {
+			list = append(list, *b)
+		}
+		s.mu.Unlock()
+		respondJSON(w, http.StatusOK, list)
+	case "POST":
+		var req struct {
+			Package string   `json:"package"`
+			Flags   []string `json:"flags"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkServeBuild(req.Package, req.Flags); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, err := s.submit(req.Package, req.Flags)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		respondJSON(w, http.StatusAccepted, b)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// checkServeBuild checks that a build of pkg with flags can be run on the
+// server: the package must be an import path or a source archive, other than
+// the name of a command, and the flags those in serveFlags, given as -name or
+// -name=value
+func checkServeBuild(pkg string, flags []string) error {
+	if pkg == "" || strings.HasPrefix(pkg, "-") || isLocalPath(pkg) {
+		return fmt.Errorf("package must be an import path or the URL of a source archive")
+	}
+	// goaci would run the command instead of building
+	if _, ok := commands[pkg]; ok {
+		return fmt.Errorf("package %q is the name of a goaci command", pkg)
+	}
+	for _, f := range flags {
+		name := strings.SplitN(strings.TrimLeft(f, "-"), "=", 2)[0]
+		if !strings.HasPrefix(f, "-") || !serveFlags[name] {
+			return fmt.Errorf("flag %q is not allowed", f)
+		}
+		// Images are served as files, and an OCI layout is a directory
+		if name == "format" && strings.HasSuffix(f, "=oci") {
+			return fmt.Errorf("flag %q is not allowed, use -format=oci-archive", f)
+		}
+	}
+	return nil
+}
+
+// submit queues a build of pkg with flags
+func (s *server) submit(pkg string, flags []string) (*serveBuild, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	b := &serveBuild{
+		ID:      hex.EncodeToString(id),
+		Package: pkg,
+		Flags:   flags,
+		Status:  "queued",
+		done:    make(chan struct{}),
+	}
+	b.dir = filepath.Join(s.dir, b.ID)
+	if err := os.Mkdir(b.dir, 0755); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.builds[b.ID] = b
+	s.mu.Unlock()
+	go s.run(b)
+	return b, nil
+}
+
+// run runs the build b once there is a free slot
+func (s *server) run(b *serveBuild) {
+	defer close(b.done)
+	s.slots <- struct{}{}
+	defer func() { <-s.slots }()
+	s.setStatus(b, "running", nil)
+
+	log, err := os.Create(filepath.Join(b.dir, "log"))
+	if err != nil {
+		s.setStatus(b, "failed", err)
+		return
+	}
+	// The images go in the directory of the build, whatever the flags of
+	// the server say
+	args := append(append([]string(nil), s.flags...), "-o", b.dir)
+	args = append(append(args, b.Flags...), b.Package)
+	cmd := exec.Command(s.self, args...)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	logCommand(cmd.Args)
+	err = cmd.Run()
+	log.Close()
+
+	if err != nil {
+		s.setStatus(b, "failed", err)
+		return
+	}
+	// Failed builds may leave images half written, so they are only
+	// listed now
+	fi, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		s.setStatus(b, "failed", err)
+		return
+	}
+	s.mu.Lock()
+	for _, f := range fi {
+		if f.Name() != "log" {
+			b.Images = append(b.Images, f.Name())
+		}
+	}
+	s.mu.Unlock()
+	s.setStatus(b, "succeeded", nil)
+}
+
+func (s *server) setStatus(b *serveBuild, status string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b.Status = status
+	if err != nil {
+		b.Error = err.Error()
+	}
+	info("Build %s of %s %s", b.ID, b.Package, status)
+}
+
+func (s *server) handleBuild(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/builds/"), "/", 3)
+	s.mu.Lock()
+	b, ok := s.builds[parts[0]]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case len(parts) == 1:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		respondJSON(w, http.StatusOK, b)
+	case len(parts) == 2 && parts[1] == "log":
+		streamLog(w, r, filepath.Join(b.dir, "log"), b.done)
+	case len(parts) == 3 && parts[1] == "images":
+		// Only what the build wrote is served
+		s.mu.Lock()
+		found := false
+		for _, name := range b.Images {
+			found = found || name == parts[2]
+		}
+		s.mu.Unlock()
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(b.dir, parts[2]))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// streamLog sends the log file at path as it is written, until done is
+// closed or the client goes away
+func streamLog(w http.ResponseWriter, r *http.Request, path string, done chan struct{}) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	flusher, _ := w.(http.Flusher)
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	for {
+		finished := false
+		select {
+		case <-done:
+			finished = true
+		case <-r.Context().Done():
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+		// The log is only created once the build runs
+		if f == nil {
+			var err error
+			if f, err = os.Open(path); err != nil && !os.IsNotExist(err) {
+				return
+			}
+		}
+		if f != nil {
+			if _, err := io.Copy(w, f); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if finished {
+			return
+		}
+	}
+}
+
+func respondJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
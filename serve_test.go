@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestCheckServeBuild(t *testing.T) {
+	tests := []struct {
+		pkg   string
+		flags []string
+		ok    bool
+	}{
+		{"example.com/myapp", nil, true},
+		{"example.com/myapp", []string{"-cgo", "-image-version=v1", "--revision=v1.0"}, true},
+		{"", nil, false},
+		{"-cgo", nil, false},
+		{"./cmd/myapp", nil, false},
+		{"/src/myapp", nil, false},
+		// goaci would run these commands instead of building
+		{"serve", nil, false},
+		{"batch", nil, false},
+		{"inspect", nil, false},
+		// Flags running commands on the server or touching its files
+		{"example.com/myapp", []string{"-asset=/etc/shadow:/shadow"}, false},
+		{"example.com/myapp", []string{"-asset-hook=rm -rf /"}, false},
+		{"example.com/myapp", []string{"-o=/etc"}, false},
+		{"example.com/myapp", []string{"-local-source=/"}, false},
+		{"example.com/myapp", []string{"-build-env=CC=/tmp/evil"}, false},
+		{"example.com/myapp", []string{"-push=https://example.com/"}, false},
+		// Only images written as single files can be downloaded
+		{"example.com/myapp", []string{"-format=oci-archive"}, true},
+		{"example.com/myapp", []string{"-format=oci"}, false},
+		{"example.com/myapp", []string{"--format=oci"}, false},
+		// Flags must be given as one argument
+		{"example.com/myapp", []string{"-image-version", "v1"}, false},
+		{"example.com/myapp", []string{"cgo"}, false},
+		{"example.com/myapp", []string{"-"}, false},
+	}
+	for _, tt := range tests {
+		err := checkServeBuild(tt.pkg, tt.flags)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkServeBuild(%q, %q) = %v, want ok %v", tt.pkg, tt.flags, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxShebang is the longest #! line the kernel reads
+const maxShebang = 256
+
+// readShebang returns the interpreter and its optional argument from the #!
+// line of the file at path, if it has one. Like the kernel does, the
+// interpreter ends at the first blank, and all that follows is a single
+// argument.
+func readShebang(path string) (interp, arg string, ok bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", false, err
+	}
+	defer f.Close()
+	// Longer lines are cut short, as by the kernel
+	line, err := bufio.NewReaderSize(f, maxShebang).ReadSlice('\n')
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", "", false, err
+	}
+	if !strings.HasPrefix(string(line), "#!") {
+		return "", "", false, nil
+	}
+	s := strings.Trim(string(line[2:]), " \t\r\n")
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		interp, arg = s[:i], strings.TrimLeft(s[i:], " \t")
+	} else {
+		interp = s
+	}
+	if interp == "" {
+		return "", "", false, nil
+	}
+	return interp, arg, true, nil
+}
+
+// envProgram returns the program run by env with the given argument, which
+// may hold several words when env is given -S, skipping options and variable
+// assignments
+func envProgram(arg string) string {
+	for _, w := range strings.Fields(arg) {
+		if strings.HasPrefix(w, "-") || strings.Contains(w, "=") {
+			continue
+		}
+		return w
+	}
+	return ""
+}
+
+// addInterpreters adds the interpreters named in the #! lines of the
+// executable files in the rootfs. Programs run through env are looked up in
+// the PATH of the build host and added at the same place in the image.
+// Interpreters are added before library dependencies are resolved, so that
+// they get theirs, too.
+func addInterpreters(fs *rootfs) error {
+	queue := fs.paths()
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		src := fs.entries[p]
+		if src == "" {
+			continue
+		}
+		info, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+			continue
+		}
+		interp, arg, ok, err := readShebang(src)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		progs := []string{interp}
+		if path.Base(interp) == "env" {
+			prog := envProgram(arg)
+			if prog == "" {
+				return fmt.Errorf("can't tell the program run by %s in the #! line of %s", interp, src)
+			}
+			if !strings.Contains(prog, "/") {
+				if prog, err = exec.LookPath(prog); err != nil {
+					return fmt.Errorf("can't find the interpreter of %s: %v", src, err)
+				}
+			}
+			progs = append(progs, prog)
+		}
+		for _, prog := range progs {
+			if !path.IsAbs(prog) {
+				return fmt.Errorf("interpreter %s of %s is not an absolute path", prog, src)
+			}
+			if fs.has(prog) {
+				continue
+			}
+			real, err := filepath.EvalSymlinks(prog)
+			if err != nil {
+				return fmt.Errorf("can't find the interpreter of %s: %v", src, err)
+			}
+			debug("adding interpreter of ", p, ": ", prog)
+			fs.addDep(prog, real)
+			// Interpreters may be scripts themselves
+			queue = append(queue, cleanRootfsPath(prog))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadShebang(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goaci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		contents    string
+		interp, arg string
+		ok          bool
+	}{
+		{"#!/bin/sh\necho hi\n", "/bin/sh", "", true},
+		{"#!/bin/sh", "/bin/sh", "", true},
+		{"#! /bin/sh -e\n", "/bin/sh", "-e", true},
+		{"#!/usr/bin/env python3 -u\n", "/usr/bin/env", "python3 -u", true},
+		{"#!/usr/bin/env\t-S  node --harmony \r\n", "/usr/bin/env", "-S  node --harmony", true},
+		{"#!\n", "", "", false},
+		{"#!   \n", "", "", false},
+		{"echo hi\n", "", "", false},
+		{"", "", "", false},
+		{"\x7fELF", "", "", false},
+		// Cut short at the length the kernel reads
+		{"#!/bin/sh " + strings.Repeat("x", maxShebang) + "\n", "/bin/sh", strings.Repeat("x", maxShebang-len("#!/bin/sh ")), true},
+	}
+	for _, tt := range tests {
+		p := filepath.Join(dir, "script")
+		if err := ioutil.WriteFile(p, []byte(tt.contents), 0755); err != nil {
+			t.Fatal(err)
+		}
+		interp, arg, ok, err := readShebang(p)
+		if err != nil {
+			t.Errorf("readShebang(%q): %v", tt.contents, err)
+			continue
+		}
+		if interp != tt.interp || arg != tt.arg || ok != tt.ok {
+			t.Errorf("readShebang(%q) = %q, %q, %v, want %q, %q, %v", tt.contents, interp, arg, ok, tt.interp, tt.arg, tt.ok)
+		}
+	}
+}
+
+func TestEnvProgram(t *testing.T) {
+	tests := []struct {
+		arg, want string
+	}{
+		{"python3", "python3"},
+		{"python3 -u", "python3"},
+		{"-S node --harmony", "node"},
+		{"-i PATH=/bin sh", "sh"},
+		{"LANG=C  perl -w", "perl"},
+		{"-", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := envProgram(tt.arg); got != tt.want {
+			t.Errorf("envProgram(%q) = %q, want %q", tt.arg, got, tt.want)
+		}
+	}
+}
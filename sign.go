@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// signImage writes a detached, armored signature of the file at path to
+// path.asc using gpg, as expected by rkt, and returns the signature's path
+func signImage(path, keyID, homedir string) (string, error) {
+	gpgcmd, err := exec.LookPath("gpg")
+	if err != nil {
+		return "", fmt.Errorf("could not find `gpg` in path")
+	}
+	sig := path + ".asc"
+	args := []string{
+		gpgcmd,
+		"--batch",
+		"--yes",
+		"--armor",
+		"--detach-sign",
+		"--local-user", keyID,
+		"--output", sig,
+	}
+	if homedir != "" {
+		args = append(args, "--homedir", homedir)
+	}
+	args = append(args, path)
+
+	cmd := exec.CommandContext(ctx, gpgcmd, args[1:]...)
+	cmd.Stderr = commandStderr()
+	cmd.Stdout = commandStdout()
+	logCommand(cmd.Args)
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return sig, nil
+}
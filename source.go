@@ -0,0 +1,262 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isSourceURL reports whether the package argument, or -local-source, is the
+// URL of an archive of the source rather than an import path or directory
+func isSourceURL(arg string) bool {
+	return strings.HasPrefix(arg, "https://")
+}
+
+// fetchSource downloads the source archive at url, a tarball (compressed
+// with gzip or xz, or not at all) or zip file, and unpacks it into dir. The
+// archive is pinned by its sha256 hash pin, if not empty, or by a
+// #sha256=<hex> fragment of the URL. It returns the directory holding the
+// source, which is the single top-level directory of the archive if it has
+// one, as most archives of releases do.
+func fetchSource(url, pin, dir string) (string, error) {
+	pin = strings.ToLower(pin)
+	if i := strings.Index(url, "#"); i >= 0 {
+		var frag string
+		url, frag = url[:i], url[i+1:]
+		if !strings.HasPrefix(frag, "sha256=") {
+			return "", fmt.Errorf("bad fragment %q, must be sha256=<hex>", frag)
+		}
+		frag = strings.ToLower(strings.TrimPrefix(frag, "sha256="))
+		if pin != "" && pin != frag {
+			return "", fmt.Errorf("the URL pins %s with sha256 %s, but -source-sha256 is %s", url, frag, pin)
+		}
+		pin = frag
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	debug("downloading ", url)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("downloading %s: %s", url, resp.Status)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(dir), "source")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	p := newProgress("downloading "+url, resp.ContentLength)
+	if _, err := io.Copy(io.MultiWriter(f, h, progressWriter{p}), resp.Body); err != nil {
+		return "", fmt.Errorf("downloading %s: %v", url, err)
+	}
+	p.done()
+	sum := hex.EncodeToString(h.Sum(nil))
+	switch {
+	case pin == "":
+		warn("%s is not pinned; add #sha256=%s to the URL, or give -source-sha256, to make sure it is what was built before", url, sum)
+	case pin != sum:
+		return "", fmt.Errorf("%s has sha256 %s, not %s", url, sum, pin)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return "", fmt.Errorf("%s is not an archive", url)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if bytes.Equal(magic, []byte("PK\x03\x04")) {
+		err = unpackZip(f, dir)
+	} else {
+		err = unpackTar(f, dir)
+	}
+	if err != nil {
+		return "", fmt.Errorf("unpacking %s: %v", url, err)
+	}
+
+	fi, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(fi) == 1 && fi[0].IsDir() {
+		return filepath.Join(dir, fi[0].Name()), nil
+	}
+	return dir, nil
+}
+
+// progressWriter tells p about what is written to it
+type progressWriter struct {
+	p *progress
+}
+
+func (w progressWriter) Write(b []byte) (int, error) {
+	w.p.add(int64(len(b)))
+	return len(b), nil
+}
+
+// unpackTar unpacks the tarball read from r into dir. Only directories,
+// regular files, symlinks and hard links are unpacked, with their
+// permissions but not setuid, setgid and sticky bits.
+func unpackTar(r io.Reader, dir string) error {
+	dr, err := newDecompressor(r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target, err := unpackPath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		mode := os.FileMode(hdr.Mode) & os.ModePerm
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, mode|0700)
+		case tar.TypeReg, tar.TypeRegA:
+			err = unpackFile(target, mode, tr)
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, target)
+		case tar.TypeLink:
+			var first string
+			if first, err = unpackPath(dir, hdr.Linkname); err == nil {
+				err = os.Link(first, target)
+			}
+		default:
+			debug("leaving out ", hdr.Name, " of unsupported type ", string(hdr.Typeflag))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// unpackZip unpacks the zip file f into dir, the same way as unpackTar
+func unpackZip(f *os.File, dir string) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		target, err := unpackPath(dir, zf.Name)
+		if err != nil {
+			return err
+		}
+		mode := zf.Mode()
+		switch {
+		case mode.IsDir():
+			err = os.MkdirAll(target, mode.Perm()|0700)
+		case mode&os.ModeSymlink != 0:
+			var link []byte
+			if link, err = readZipFile(zf); err == nil {
+				err = os.Symlink(string(link), target)
+			}
+		case mode.IsRegular():
+			var rc io.ReadCloser
+			if rc, err = zf.Open(); err == nil {
+				err = unpackFile(target, mode.Perm(), rc)
+				rc.Close()
+			}
+		default:
+			debug("leaving out ", zf.Name, " of unsupported type ", mode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readZipFile(zf *zip.File) ([]byte, error) {
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// unpackFile writes what is read from r to the new file target
+func unpackFile(target string, mode os.FileMode, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// unpackPath returns where the archive entry name is unpacked in dir. Names
+// leading out of dir, directly or through symlinks unpacked before, are
+// refused.
+func unpackPath(dir, name string) (string, error) {
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	if !within(dir, target) {
+		return "", fmt.Errorf("%s is outside of the archive", name)
+	}
+	// The entry itself may be a symlink, its parents must not lead out.
+	// Those which don't exist yet are created as plain directories.
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	for p := filepath.Dir(target); ; p = filepath.Dir(p) {
+		parent, err := filepath.EvalSymlinks(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if !within(root, parent) {
+			return "", fmt.Errorf("%s is outside of the archive", name)
+		}
+		return target, nil
+	}
+}
+
+// within reports whether path is dir or below it
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
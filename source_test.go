@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnpackPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goaci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"out":    dir,
+		"abs":    "/",
+		"inside": "sub",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"a", "a", true},
+		{"a/b/c", "a/b/c", true},
+		{"./a/../b", "b", true},
+		{"/a", "a", true},
+		{"sub/new/file", "sub/new/file", true},
+		{"inside/file", "inside/file", true},
+		// Entries may be symlinks themselves
+		{"out", "out", true},
+		{"..", "", false},
+		{"../x", "", false},
+		{"a/../../x", "", false},
+		{"out/x", "", false},
+		{"abs/etc/passwd", "", false},
+		{"out/missing/x", "", false},
+	}
+	for _, tt := range tests {
+		got, err := unpackPath(root, tt.name)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("unpackPath(%q) = %q, want an error", tt.name, got)
+			}
+			continue
+		}
+		if want := filepath.Join(root, filepath.FromSlash(tt.want)); err != nil || got != want {
+			t.Errorf("unpackPath(%q) = %q, %v, want %q", tt.name, got, err, want)
+		}
+	}
+}
+
+func TestWithin(t *testing.T) {
+	tests := []struct {
+		dir, path string
+		want      bool
+	}{
+		{"/a", "/a", true},
+		{"/a", "/a/b", true},
+		{"/a", "/ab", false},
+		{"/a", "/", false},
+		{"/a/b", "/a/b/../c", false},
+		{"/", "/a", true},
+		{"a", "a/..b", true},
+	}
+	for _, tt := range tests {
+		if got := within(tt.dir, tt.path); got != tt.want {
+			t.Errorf("within(%q, %q) = %v, want %v", tt.dir, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import "os"
+
+type fileID struct{}
+
+// hardlinkID never recognizes hard links on platforms where files can't be
+// identified, so every link is copied as a separate file
+func hardlinkID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+// fileOwner never knows the owner of files on platforms without uids
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// tarOptions control how tarDir records files, so that the archives we
+// write only depend on their contents and not on who built them or when
+type tarOptions struct {
+	// mtime is recorded as the modification time of every entry
+	mtime time.Time
+	// preserveOwnership keeps the uid and gid of the files on disk,
+	// instead of recording all entries as owned by root
+	preserveOwnership bool
+	// preserveTimes keeps the modification times of the files on disk,
+	// instead of recording mtime
+	preserveTimes bool
+}
+
+// tarDir adds the contents of dir to tw, with names relative to dir, in
+// lexical order
+func tarDir(tw *tar.Writer, dir string, topts tarOptions) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relpath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if relpath == "." {
+			return nil
+		}
+		return tarFile(tw, filepath.ToSlash(relpath), path, info, topts)
+	})
+}
+
+// tarHeader returns the header for an entry name describing a file with the
+// given info. Unless the options say otherwise, the entry is owned by root.
+func tarHeader(name string, info os.FileInfo, link string, topts tarOptions) (*tar.Header, error) {
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if !topts.preserveOwnership {
+		hdr.Uid, hdr.Gid = 0, 0
+	}
+	hdr.Uname, hdr.Gname = "", ""
+	if !topts.preserveTimes {
+		hdr.ModTime = topts.mtime
+	}
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	return hdr, nil
+}
+
+// tarFile adds the file at path, described by info, to tw as name
+func tarFile(tw *tar.Writer, name, path string, info os.FileInfo, topts tarOptions) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	hdr, err := tarHeader(name, info, link, topts)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(tw, f); err != nil {
+		return fmt.Errorf("error adding %s: %v", path, err)
+	}
+	return nil
+}
+
+// tarHardlink adds a hard link to the entry target, which is the same file as
+// described by info, to tw as name
+func tarHardlink(tw *tar.Writer, name, target string, info os.FileInfo, topts tarOptions) error {
+	hdr, err := tarHeader(name, info, "", topts)
+	if err != nil {
+		return err
+	}
+	hdr.Typeflag = tar.TypeLink
+	hdr.Linkname = target
+	hdr.Size = 0
+	return tw.WriteHeader(hdr)
+}
+
+// tarDirEntry adds a directory, which has no counterpart on disk, to tw as
+// name
+func tarDirEntry(tw *tar.Writer, name string, mode os.FileMode, topts tarOptions) error {
+	m := int64(mode & os.ModePerm)
+	if mode&os.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= 01000
+	}
+	return tw.WriteHeader(&tar.Header{
+		Name:     name + "/",
+		Mode:     m,
+		ModTime:  topts.mtime,
+		Typeflag: tar.TypeDir,
+	})
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"archive/tar"
+	"os"
+
+	"github.com/appc/spec/aci"
+)
+
+func init() {
+	commands["validate"] = runValidate
+}
+
+// runValidate checks that the given images, ACI archives or unpacked ACI
+// directories, follow the app container specification
+func runValidate(args []string) {
+	if len(args) == 0 {
+		die("usage: goaci validate IMAGE...")
+	}
+	valid := true
+	for _, a := range args {
+		if err := validateImage(a); err != nil {
+			reportError("%s: %v", a, err)
+			valid = false
+			continue
+		}
+		info("%s: valid app container image", a)
+	}
+	if !valid {
+		os.Exit(1)
+	}
+}
+
+// validateImage checks the layout and manifest of the ACI at path, which may
+// be compressed, or be a directory holding an unpacked ACI
+func validateImage(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return aci.ValidateLayout(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := newDecompressor(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return aci.ValidateArchive(tar.NewReader(r))
+}
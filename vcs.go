@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/appc/spec/schema/types"
+)
+
+// gitDescribe returns the version of the git checkout in dir, as described by
+// its most recent tag, or by its commit if it has no tags, and marked as dirty
+// if it has uncommitted changes
+func gitDescribe(dir string) (string, error) {
+	return vcsOutput(dir, "git", "describe", "--tags", "--always", "--dirty")
+}
+
+// vcsOutput runs a version control command in dir and returns its output,
+// without surrounding white space. Errors include what the command printed
+// on stderr.
+func vcsOutput(dir string, args ...string) (string, error) {
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	logCommand(cmd.Args)
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// vcsInfo describes the revision of a checkout
+type vcsInfo struct {
+	// vcs is the version control system managing the checkout, "git"
+	// or "hg"
+	vcs string
+	// rev is the full id of the revision checked out
+	rev string
+	// dirty is set if tracked files have uncommitted changes
+	dirty bool
+	// branch, tag, url (of the default remote) and timestamp (of the
+	// revision, in RFC 3339 format) are empty if unknown
+	branch, tag, url, timestamp string
+}
+
+// readVCSInfo describes the checkout dir is part of, or returns nil if it is
+// not part of one
+func readVCSInfo(dir string) (*vcsInfo, error) {
+	// Errors of the commands reading optional information are ignored,
+	// e.g. git describe fails if there is no tag
+	optional := func(args ...string) string {
+		out, _ := vcsOutput(dir, args...)
+		return out
+	}
+	info := &vcsInfo{}
+	switch info.vcs, _ = vcsRoot(dir); info.vcs {
+	case "git":
+		var err error
+		if info.rev, err = vcsOutput(dir, "git", "rev-parse", "HEAD"); err != nil {
+			return nil, err
+		}
+		status, err := vcsOutput(dir, "git", "status", "--porcelain", "--untracked-files=no")
+		if err != nil {
+			return nil, err
+		}
+		info.dirty = status != ""
+		if b := optional("git", "rev-parse", "--abbrev-ref", "HEAD"); b != "HEAD" {
+			info.branch = b
+		}
+		info.tag = optional("git", "describe", "--tags", "--exact-match")
+		info.url = optional("git", "config", "--get", "remote.origin.url")
+		info.timestamp = optional("git", "show", "--no-patch", "--format=%cI", "HEAD")
+	case "hg":
+		// The id is followed by a + if there are uncommitted changes
+		id, err := vcsOutput(dir, "hg", "id", "--debug", "--id")
+		if err != nil {
+			return nil, err
+		}
+		info.rev, info.dirty = strings.TrimSuffix(id, "+"), strings.HasSuffix(id, "+")
+		info.branch = optional("hg", "branch")
+		if t := optional("hg", "id", "--tags"); t != "tip" {
+			info.tag = t
+		}
+		info.url = optional("hg", "paths", "default")
+		info.timestamp = optional("hg", "log", "--rev", ".", "--template", "{date|rfc3339date}")
+	default:
+		return nil, nil
+	}
+	return info, nil
+}
+
+// annotations returns the information about the revision, apart from the
+// revision itself, as image annotations
+func (v *vcsInfo) annotations() types.Annotations {
+	var as types.Annotations
+	for _, a := range []struct{ name, value string }{
+		{"vcs-ref", v.rev},
+		{"vcs-branch", v.branch},
+		{"vcs-tag", v.tag},
+		{"vcs-url", v.url},
+		{"vcs-timestamp", v.timestamp},
+	} {
+		if a.value != "" {
+			as = append(as, types.Annotation{Name: types.ACName(a.name), Value: a.value})
+		}
+	}
+	return as
+}
+
+// checkCommit checks that the checkout dir is part of is at the commit want,
+// which may be abbreviated, and has no uncommitted changes
+func checkCommit(dir, want string) error {
+	info, err := readVCSInfo(dir)
+	if err != nil {
+		return fmt.Errorf("error reading the revision of the project: %v", err)
+	}
+	if info == nil {
+		return fmt.Errorf("%s is not a git or hg checkout, so its commit can't be checked", dir)
+	}
+	if !strings.HasPrefix(info.rev, strings.ToLower(want)) {
+		return fmt.Errorf("%s is at commit %s, not %s", dir, info.rev, want)
+	}
+	if info.dirty {
+		return fmt.Errorf("%s has uncommitted changes, so it is not commit %s", dir, want)
+	}
+	return nil
+}
+
+// untrackedFiles returns the files below dir which are not under version
+// control, ignored ones included, relative to dir
+func untrackedFiles(dir string) ([]string, error) {
+	vcs, _ := vcsRoot(dir)
+	var out string
+	var err error
+	switch vcs {
+	case "git":
+		out, err = vcsOutput(dir, "git", "ls-files", "--others", "-z")
+	case "hg":
+		// Given a pattern, hg prints paths relative to the working
+		// directory
+		out, err = vcsOutput(dir, "hg", "status", "--unknown", "--ignored", "--no-status", "--print0", ".")
+	default:
+		return nil, nil
+	}
+	if err != nil || out == "" {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(out, "\x00"), "\x00"), nil
+}
+
+// gitCheckout checks out ref, a branch, tag or commit, in the git checkout in
+// dir
+func gitCheckout(dir, ref string) error {
+	// Which git would take as an option
+	if strings.HasPrefix(ref, "-") {
+		return fmt.Errorf("bad ref %q", ref)
+	}
+	cmd := exec.CommandContext(ctx, "git", "checkout", "--quiet", ref, "--")
+	cmd.Dir = dir
+	cmd.Stdout = commandStdout()
+	cmd.Stderr = commandStderr()
+	logCommand(cmd.Args)
+	return cmd.Run()
+}
+
+// resetCheckout checks out the default branch of the git checkout in dir
+// again, if an earlier build left it at another revision, so that go get -u
+// can update it. Other checkouts, and missing ones, are left alone.
+func resetCheckout(dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	if vcs, _ := vcsRoot(dir); vcs != "git" {
+		return nil
+	}
+	if _, err := vcsOutput(dir, "git", "symbolic-ref", "--quiet", "HEAD"); err == nil {
+		return nil
+	}
+	head, err := vcsOutput(dir, "git", "symbolic-ref", "--short", "refs/remotes/origin/HEAD")
+	if err != nil {
+		return err
+	}
+	return gitCheckout(dir, strings.TrimPrefix(head, "origin/"))
+}
+
+// applyPatch applies the patch file to the source in dir: with git apply if
+// dir is part of a git checkout, and with patch -p1 otherwise
+func applyPatch(dir, patch string) error {
+	patch, err := filepath.Abs(patch)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "patch", "-p1", "--forward", "--input", patch)
+	if inGitCheckout(dir) {
+		cmd = exec.CommandContext(ctx, "git", "apply", patch)
+	}
+	cmd.Dir = dir
+	cmd.Stdout = commandStdout()
+	cmd.Stderr = commandStderr()
+	logCommand(cmd.Args)
+	return cmd.Run()
+}
+
+// inGitCheckout reports whether dir is part of a git checkout
+func inGitCheckout(dir string) bool {
+	vcs, _ := vcsRoot(dir)
+	return vcs == "git"
+}
+
+// vcsRoot returns the version control system ("git" or "hg") managing the
+// checkout dir is part of, and the root directory of that checkout, or empty
+// strings if dir is not part of a checkout
+func vcsRoot(dir string) (vcs, root string) {
+	for d := dir; ; d = filepath.Dir(d) {
+		for _, v := range []string{"git", "hg"} {
+			if _, err := os.Stat(filepath.Join(d, "."+v)); err == nil {
+				return v, d
+			}
+		}
+		if filepath.Dir(d) == d {
+			return "", ""
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// run runs a command in dir, failing the test if it does
+func run(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%q: %v\n%s", args, err, out)
+	}
+	return string(out)
+}
+
+// gitRepo creates a git repository holding a file committed to the branch
+// work in a new temporary directory, skipping the test if git is not installed
+func gitRepo(t *testing.T) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "goaci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run(t, dir, "git", "init", "--quiet")
+	run(t, dir, "git", "symbolic-ref", "HEAD", "refs/heads/work")
+	run(t, dir, "git", "add", "main.go")
+	run(t, dir, "git", "-c", "user.name=goaci", "-c", "user.email=goaci@example.com", "commit", "--quiet", "-m", "initial")
+	return dir
+}
+
+func TestReadVCSInfo(t *testing.T) {
+	dir := gitRepo(t)
+	defer os.RemoveAll(dir)
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	head := strings.TrimSpace(run(t, dir, "git", "rev-parse", "HEAD"))
+	info, err := readVCSInfo(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := vcsInfo{vcs: "git", rev: head, branch: "work"}
+	if info == nil || info.timestamp == "" {
+		t.Fatalf("readVCSInfo of a clean checkout = %+v, want a commit time", info)
+	}
+	want.timestamp = info.timestamp
+	if *info != want {
+		t.Errorf("readVCSInfo of a clean checkout = %+v, want %+v", *info, want)
+	}
+
+	run(t, dir, "git", "tag", "v1.0")
+	run(t, dir, "git", "remote", "add", "origin", "https://example.com/app.git")
+	// Untracked files don't make a checkout dirty
+	if err := ioutil.WriteFile(filepath.Join(sub, "new.go"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = readVCSInfo(sub); err != nil {
+		t.Fatal(err)
+	}
+	want.tag, want.url = "v1.0", "https://example.com/app.git"
+	if *info != want {
+		t.Errorf("readVCSInfo of a tagged checkout = %+v, want %+v", *info, want)
+	}
+	var names []string
+	for _, a := range info.annotations() {
+		names = append(names, string(a.Name))
+	}
+	if wantNames := []string{"vcs-ref", "vcs-branch", "vcs-tag", "vcs-url", "vcs-timestamp"}; !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("annotations %q, want %q", names, wantNames)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("package other\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = readVCSInfo(sub); err != nil || !info.dirty {
+		t.Errorf("readVCSInfo with a modified file = %+v, %v, want it dirty", info, err)
+	}
+
+	outside, err := ioutil.TempDir("", "goaci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if info, err := readVCSInfo(outside); info != nil || err != nil {
+		t.Errorf("readVCSInfo of a directory outside of any checkout = %+v, %v", info, err)
+	}
+}
+
+func TestReadVCSInfoHg(t *testing.T) {
+	if _, err := exec.LookPath("hg"); err != nil {
+		t.Skip("hg is not installed")
+	}
+	dir, err := ioutil.TempDir("", "goaci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run(t, dir, "hg", "init")
+	run(t, dir, "hg", "add", "main.go")
+	run(t, dir, "hg", "commit", "--user", "goaci", "-m", "initial")
+	id := strings.TrimSpace(run(t, dir, "hg", "log", "--rev", ".", "--template", "{node}"))
+
+	info, err := readVCSInfo(dir)
+	if err != nil || info == nil {
+		t.Fatalf("readVCSInfo = %+v, %v", info, err)
+	}
+	if info.vcs != "hg" || info.rev != id || info.dirty || info.branch != "default" || info.tag != "" || info.timestamp == "" {
+		t.Errorf("readVCSInfo of a clean checkout = %+v, want revision %s of the default branch", *info, id)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("package other\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = readVCSInfo(dir); err != nil || info.rev != id || !info.dirty {
+		t.Errorf("readVCSInfo with a modified file = %+v, %v, want revision %s, dirty", info, err, id)
+	}
+}
+
+func TestGitCheckout(t *testing.T) {
+	dir := gitRepo(t)
+	defer os.RemoveAll(dir)
+	run(t, dir, "git", "tag", "v1.0")
+	if err := gitCheckout(dir, "v1.0"); err != nil {
+		t.Errorf("gitCheckout(v1.0): %v", err)
+	}
+	// Refs which git would take as options
+	if err := gitCheckout(dir, "--pathspec-from-file=/etc/passwd"); err == nil {
+		t.Errorf("gitCheckout accepted a ref starting with a dash")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// verifyTimeout is how long the program of the image is given to exit when
+// verifying the rootfs; programs which keep running have started, at least
+const verifyTimeout = 10 * time.Second
+
+// verifyRootfs runs the command args, the Exec of the image, with --version
+// and then --help in the root filesystem laid out in dir, to check that it
+// can be run there, without the libraries of the host. It fails if the
+// program can't be started, i.e. the loader or libraries are missing, but
+// not if the program doesn't like the flags: that it ran at all is enough.
+//
+// The root filesystem is entered with a plain chroot, as systemd-nspawn
+// refuses directories not looking like an OS tree, like most images.
+func verifyRootfs(dir string, args []string) error {
+	chroot, err := exec.LookPath("chroot")
+	if err != nil {
+		return fmt.Errorf("could not find `chroot` in path")
+	}
+	for _, flag := range []string{"--version", "--help"} {
+		tctx, cancel := context.WithTimeout(ctx, verifyTimeout)
+		var out bytes.Buffer
+		cmd := exec.CommandContext(tctx, chroot, append(append([]string{dir}, args...), flag)...)
+		// Nothing of the host's environment is in the image
+		cmd.Env = []string{}
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		logCommand(cmd.Args)
+		err := cmd.Run()
+		timedOut := tctx.Err() == context.DeadlineExceeded
+		cancel()
+		switch {
+		case err == nil:
+			return nil
+		case timedOut:
+			debug(args[0], " is still running after ", verifyTimeout, ", so it started")
+			return nil
+		}
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return err
+		}
+		status, ok := exitErr.Sys().(syscall.WaitStatus)
+		// chroot exits with 126 and 127 if it can't run the program,
+		// and so does the dynamic loader if it can't load a library
+		if !ok || status.Signaled() || status.ExitStatus() == 126 || status.ExitStatus() == 127 {
+			return fmt.Errorf("%s %s: %v: %s", strings.Join(args, " "), flag, err, strings.TrimSpace(out.String()))
+		}
+		debug(args[0], " ", flag, " exited with status ", status.ExitStatus())
+	}
+	return nil
+}
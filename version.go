@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/appc/spec/schema"
+)
+
+// Version is the version of goaci, set at build time with
+// -ldflags "-X main.Version=..."
+var Version = "dev"
+
+// runVersion prints the version of goaci, of the app container specification
+// the images it writes follow and of the go runtime it was built with
+func runVersion(args []string) {
+	if len(args) > 0 {
+		die("usage: goaci version")
+	}
+	fmt.Println("goaci version", Version)
+	fmt.Println("appc spec version", schema.AppContainerVersion)
+	fmt.Printf("go version %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha512"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func init() {
+	commands["watch"] = runWatch
+}
+
+// watchInterval is how often the source is checked for changes
+const watchInterval = time.Second
+
+// fileState is what tells whether a file changed
+type fileState struct {
+	size    int64
+	modTime time.Time
+	mode    os.FileMode
+}
+
+// runWatch builds an image from a local source, as goaci would with the
+// same flags and arguments, and builds it again whenever the source
+// changes, until interrupted. The source is polled every watchInterval,
+// rather than watched through inotify. Each build runs goaci anew, so that
+// it starts from a clean slate.
+func runWatch(args []string) {
+	// The flags given after the command are passed on, too
+	build := append(commandFlags(args), args...)
+	if err := flag.CommandLine.Parse(args); err != nil {
+		die(err.Error())
+	}
+	if flag.NArg() != 1 {
+		die("usage: goaci [flags] watch [flags] PACKAGE (built again whenever its source changes, checked every %v)", watchInterval)
+	}
+	dir := *localSource
+	if isLocalPath(flag.Arg(0)) {
+		dir = flag.Arg(0)
+	}
+	if dir == "" || isSourceURL(dir) {
+		die("watch needs a local source: a directory as the package, or -local-source")
+	}
+	dir = strings.TrimSuffix(dir, "/...")
+	// Packages of a module may use any other package in it
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+		if root, _, ok, err := findModule(dir); err == nil && ok {
+			dir = root
+		}
+	}
+	self, err := os.Executable()
+	if err != nil {
+		die(err.Error())
+	}
+	handleInterrupts()
+	for {
+		runBuild(self, build)
+		// Whatever the build wrote in the source is not a change
+		state, err := sourceState(dir)
+		if err != nil {
+			die("error reading the source: %v", err)
+		}
+		info("Watching %s for changes", dir)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchInterval):
+			}
+			now, err := sourceState(dir)
+			if err != nil {
+				die("error reading the source: %v", err)
+			}
+			if changed(state, now) {
+				break
+			}
+		}
+	}
+}
+
+// runBuild runs goaci with args, and reports the image key of the ACIs it
+// wrote. Failed builds are reported, but don't stop watching.
+func runBuild(self string, args []string) {
+	// Not stopped through ctx: an interrupt from the terminal reaches the
+	// build, too, which then cleans up after itself
+	cmd := exec.Command(self, args...)
+	cmd.Stderr = stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		die(err.Error())
+	}
+	logCommand(cmd.Args)
+	if err := cmd.Start(); err != nil {
+		die(err.Error())
+	}
+	var written []string
+	s := bufio.NewScanner(out)
+	for s.Scan() {
+		fmt.Fprintln(stdout, s.Text())
+		if f := wroteFile(s.Text()); strings.HasSuffix(f, ".aci") {
+			written = append(written, f)
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() == nil {
+			warn("build failed: %v", err)
+		}
+		return
+	}
+	for _, f := range written {
+		key, err := aciKey(f)
+		if err != nil {
+			warn("error reading %s: %v", f, err)
+			continue
+		}
+		info("Image key of %s: %s", f, key)
+	}
+}
+
+// aciKey returns the image key of the ACI at path
+func aciKey(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	r, err := newDecompressor(f)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := sha512.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return imageKey(h), nil
+}
+
+// sourceState returns the state of the files below dir, leaving out the
+// metadata of version control systems
+func sourceState(dir string) (map[string]fileState, error) {
+	state := map[string]fileState{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files may go away while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() && (info.Name() == ".git" || info.Name() == ".hg") {
+			return filepath.SkipDir
+		}
+		state[path] = fileState{info.Size(), info.ModTime(), info.Mode()}
+		return nil
+	})
+	return state, err
+}
+
+// changed reports whether any file was added, removed or changed between the
+// states a and b
+func changed(a, b map[string]fileState) bool {
+	if len(a) != len(b) {
+		return true
+	}
+	for p, s := range a {
+		if t, ok := b[p]; !ok || t != s {
+			return true
+		}
+	}
+	return false
+}